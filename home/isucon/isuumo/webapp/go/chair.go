@@ -2,14 +2,18 @@ package main
 
 import (
 	"database/sql"
-	"encoding/csv"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo"
 )
 
+const maxReportedRangeIDMismatches = 10
+
 type Chair struct {
 	ID          int64  `db:"id" json:"id"`
 	Name        string `db:"name" json:"name"`
@@ -43,6 +47,14 @@ func getChairDetail(c echo.Context) error {
 		return c.NoContent(http.StatusBadRequest)
 	}
 
+	if chair, found, ok := chairCache.Get(int64(id)); ok {
+		if !found {
+			c.Echo().Logger.Infof("requested id's chair not found or sold out : %v", id)
+			return c.NoContent(http.StatusNotFound)
+		}
+		return c.JSON(http.StatusOK, chair)
+	}
+
 	chair := Chair{}
 	query := `SELECT id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock FROM chair WHERE id = ?`
 	err = db.Get(&chair, query, id)
@@ -61,22 +73,142 @@ func getChairDetail(c echo.Context) error {
 	return c.JSON(http.StatusOK, chair)
 }
 
-func postChair(c echo.Context) error {
-	header, err := c.FormFile("chairs")
+func chairFromRecord(rm *RecordMapper) (Chair, error) {
+	var chair Chair
+	chair.ID = int64(rm.NextInt())
+	chair.Name = rm.NextString()
+	chair.Description = rm.NextString()
+	chair.Thumbnail = rm.NextString()
+	chair.Price = int64(rm.NextInt())
+	chair.Height = int64(rm.NextInt())
+	chair.Width = int64(rm.NextInt())
+	chair.Depth = int64(rm.NextInt())
+	chair.Color = rm.NextString()
+	chair.Features = rm.NextString()
+	chair.Kind = rm.NextString()
+	chair.Popularity = int64(rm.NextInt())
+	chair.Stock = int64(rm.NextInt())
+	return chair, rm.Err()
+}
+
+// chairJSON JSON で取り込む椅子、キーは API が返す Chair と同じで、返さない popularity と stock を足したもの
+// popularity が無ければ 0、stock が無ければ1脚として取り込む
+type chairJSON struct {
+	Chair
+	Popularity int64  `json:"popularity"`
+	Stock      *int64 `json:"stock"`
+}
+
+// chairJSONRequired CSV の必須の列のうち、JSON でも必須のキー
+var chairJSONRequired = []string{"id", "name", "price", "height", "width", "depth", "color", "kind"}
+
+func chairFromJSON(raw []byte, unknown map[string]bool) (Chair, error) {
+	var cj chairJSON
+	if err := decodeJSONRecord(raw, &cj, chairJSONRequired, unknown); err != nil {
+		return Chair{}, err
+	}
+	chair := cj.Chair
+	chair.Popularity = cj.Popularity
+	chair.Stock = 1
+	if cj.Stock != nil {
+		chair.Stock = *cj.Stock
+	}
+	return chair, nil
+}
+
+func bulkInsertChairs(tx *sql.Tx, chairs []Chair, upsert bool) error {
+	if len(chairs) == 0 {
+		return nil
+	}
+	params := make([]interface{}, 0, len(chairs)*16)
+	for _, chair := range chairs {
+		priceRangeID := rangeID(chairSearchCondition.Price, chair.Price)
+		heightRangeID := rangeID(chairSearchCondition.Height, chair.Height)
+		params = append(params, chair.ID, chair.Name, chair.Description, chair.Thumbnail, chair.Price, chair.Height, chair.Width, chair.Depth, chair.Color, chair.Features, chair.Kind, chair.Popularity, chair.Stock, chair.Stock > 0, priceRangeID, heightRangeID)
+	}
+	query := bulkInsertSQL("chair", []string{"id", "name", "description", "thumbnail", "price", "height", "width", "depth", "color", "features", "kind", "popularity", "stock", "stock_flag", "price_range_id", "height_range_id"}, "(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)", len(chairs), upsert)
+	_, err := tx.Exec(query, params...)
+	return err
+}
+
+// chairBatch CSV から読んだ椅子をためて chair にまとめて INSERT する
+type chairBatch struct {
+	tx       *sql.Tx
+	upsert   bool
+	rows     []Chair
+	inserted []Chair
+}
+
+func (b *chairBatch) Add(rm *RecordMapper) error {
+	chair, err := chairFromRecord(rm)
 	if err != nil {
-		c.Logger().Errorf("failed to get form file: %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		return err
 	}
-	f, err := header.Open()
+	b.rows = append(b.rows, chair)
+	return nil
+}
+
+func (b *chairBatch) AddJSON(raw []byte, unknown map[string]bool) error {
+	chair, err := chairFromJSON(raw, unknown)
 	if err != nil {
-		c.Logger().Errorf("failed to open form file: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return err
+	}
+	b.rows = append(b.rows, chair)
+	return nil
+}
+
+func (b *chairBatch) Len() int {
+	return len(b.rows)
+}
+
+// insert upsert では上書きする椅子の保留中の予約も取り消す
+func (b *chairBatch) insert(rows []Chair) error {
+	if err := bulkInsertChairs(b.tx, rows, b.upsert); err != nil {
+		return err
+	}
+	if !b.upsert {
+		return nil
 	}
-	defer f.Close()
-	records, err := csv.NewReader(f).ReadAll()
+	ids := make([]int64, len(rows))
+	for i, chair := range rows {
+		ids[i] = chair.ID
+	}
+	return cancelChairReservations(b.tx, ids)
+}
+
+func (b *chairBatch) Flush() error {
+	err := withSavepoint(b.tx, func() error { return b.insert(b.rows) })
 	if err != nil {
-		c.Logger().Errorf("failed to read csv: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return err
+	}
+	b.inserted = append(b.inserted, b.rows...)
+	b.rows = b.rows[:0]
+	return nil
+}
+
+func (b *chairBatch) FlushRow(i int) error {
+	err := withSavepoint(b.tx, func() error { return b.insert(b.rows[i : i+1]) })
+	if err != nil {
+		return err
+	}
+	b.inserted = append(b.inserted, b.rows[i])
+	return nil
+}
+
+func (b *chairBatch) Reset() {
+	b.rows = b.rows[:0]
+}
+
+func postChair(c echo.Context) error {
+	mode, err := parseImportMode(c)
+	if err != nil {
+		c.Logger().Infof("postChair : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	upsert, err := parseUpsert(c)
+	if err != nil {
+		c.Logger().Infof("postChair : %v", err)
+		return c.NoContent(http.StatusBadRequest)
 	}
 
 	tx, err := db.Begin()
@@ -85,148 +217,167 @@ func postChair(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 	defer tx.Rollback()
-	for _, row := range records {
-		rm := RecordMapper{Record: row}
-		id := rm.NextInt()
-		name := rm.NextString()
-		description := rm.NextString()
-		thumbnail := rm.NextString()
-		price := rm.NextInt()
-		height := rm.NextInt()
-		width := rm.NextInt()
-		depth := rm.NextInt()
-		color := rm.NextString()
-		features := rm.NextString()
-		kind := rm.NextString()
-		popularity := rm.NextInt()
-		stock := rm.NextInt()
-		if err := rm.Err(); err != nil {
-			c.Logger().Errorf("failed to read record: %v", err)
-			return c.NoContent(http.StatusBadRequest)
-		}
-		_, err := tx.Exec("INSERT INTO chair(id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?)", id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock)
-		if err != nil {
-			c.Logger().Errorf("failed to insert chair: %v", err)
-			return c.NoContent(http.StatusInternalServerError)
-		}
+
+	batch := &chairBatch{tx: tx, upsert: upsert}
+	report, err := importRequest(c, "chairs", mode, chairCSVColumns, batch)
+	if errors.Is(err, errInvalidImportBody) {
+		c.Logger().Infof("postChair : %v", err)
+		return c.NoContent(http.StatusBadRequest)
 	}
-	if err := tx.Commit(); err != nil {
+	if err != nil {
+		c.Logger().Errorf("failed to import chairs: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if report.Failed() {
+		c.Logger().Infof("postChair rejected %v lines", len(report.Rejected))
+		return c.JSON(http.StatusBadRequest, report)
+	}
+
+	if err := commitChairCache(tx, func() { chairCache.Add(batch.inserted) }); err != nil {
 		c.Logger().Errorf("failed to commit tx: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	return c.NoContent(http.StatusCreated)
+	return c.JSON(http.StatusCreated, report)
 }
 
-func searchChairs(c echo.Context) error {
-	conditions := make([]string, 0)
-	params := make([]interface{}, 0)
+func parseChairSearchFilter(c echo.Context) (ChairSearchFilter, error) {
+	var filter ChairSearchFilter
 
 	if c.QueryParam("priceRangeId") != "" {
-		conditions = append(conditions, "price_range_id = ?")
-		params = append(params, c.QueryParam("priceRangeId"))
+		chairPrice, err := getRange(chairSearchCondition.Price, c.QueryParam("priceRangeId"))
+		if err != nil {
+			return filter, fmt.Errorf("priceRangeID invalid, %v : %v", c.QueryParam("priceRangeId"), err)
+		}
+		filter.Price = chairPrice
 	}
 
 	if c.QueryParam("heightRangeId") != "" {
-		conditions = append(conditions, "height_range_id = ?")
-		params = append(params, c.QueryParam("heightRangeId"))
+		chairHeight, err := getRange(chairSearchCondition.Height, c.QueryParam("heightRangeId"))
+		if err != nil {
+			return filter, fmt.Errorf("heightRangeId invalid, %v : %v", c.QueryParam("heightRangeId"), err)
+		}
+		filter.Height = chairHeight
 	}
 
 	if c.QueryParam("widthRangeId") != "" {
 		chairWidth, err := getRange(chairSearchCondition.Width, c.QueryParam("widthRangeId"))
 		if err != nil {
-			c.Echo().Logger.Infof("widthRangeID invalid, %v : %v", c.QueryParam("widthRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
-		}
-
-		if chairWidth.Min != -1 {
-			conditions = append(conditions, "width >= ?")
-			params = append(params, chairWidth.Min)
-		}
-		if chairWidth.Max != -1 {
-			conditions = append(conditions, "width < ?")
-			params = append(params, chairWidth.Max)
+			return filter, fmt.Errorf("widthRangeID invalid, %v : %v", c.QueryParam("widthRangeId"), err)
 		}
+		filter.Width = chairWidth
 	}
 
 	if c.QueryParam("depthRangeId") != "" {
 		chairDepth, err := getRange(chairSearchCondition.Depth, c.QueryParam("depthRangeId"))
 		if err != nil {
-			c.Echo().Logger.Infof("depthRangeId invalid, %v : %v", c.QueryParam("depthRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
-		}
-
-		if chairDepth.Min != -1 {
-			conditions = append(conditions, "depth >= ?")
-			params = append(params, chairDepth.Min)
-		}
-		if chairDepth.Max != -1 {
-			conditions = append(conditions, "depth < ?")
-			params = append(params, chairDepth.Max)
+			return filter, fmt.Errorf("depthRangeId invalid, %v : %v", c.QueryParam("depthRangeId"), err)
 		}
+		filter.Depth = chairDepth
 	}
 
-	if c.QueryParam("kind") != "" {
-		conditions = append(conditions, "kind = ?")
-		params = append(params, c.QueryParam("kind"))
+	filter.Kind = c.QueryParam("kind")
+	filter.Color = c.QueryParam("color")
+
+	if c.QueryParam("features") != "" {
+		filter.Features = strings.Split(c.QueryParam("features"), ",")
 	}
 
-	if c.QueryParam("color") != "" {
-		conditions = append(conditions, "color = ?")
-		params = append(params, c.QueryParam("color"))
+	return filter, nil
+}
+
+func deleteChair(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return c.NoContent(http.StatusBadRequest)
 	}
 
-	if c.QueryParam("features") != "" {
-		for _, f := range strings.Split(c.QueryParam("features"), ",") {
-			conditions = append(conditions, "features LIKE CONCAT('%', ?, '%')")
-			params = append(params, f)
-		}
+	tx, err := db.Begin()
+	if err != nil {
+		c.Logger().Errorf("failed to begin tx: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
+	defer tx.Rollback()
 
-	if len(conditions) == 0 {
-		c.Echo().Logger.Infof("Search condition not found")
-		return c.NoContent(http.StatusBadRequest)
+	res, err := tx.Exec("DELETE FROM chair WHERE id = ?", id)
+	if err != nil {
+		c.Logger().Errorf("failed to delete chair: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		c.Echo().Logger.Infof("deleteChair chair id %v not found", id)
+		return c.NoContent(http.StatusNotFound)
+	}
+	if err := cancelChairReservations(tx, []int64{int64(id)}); err != nil {
+		c.Logger().Errorf("failed to cancel chair reservations: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	conditions = append(conditions, "stock_flag = TRUE")
+	if err := commitChairCache(tx, func() { chairCache.Delete(int64(id)) }); err != nil {
+		c.Logger().Errorf("failed to commit tx: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
 
-	page, err := strconv.Atoi(c.QueryParam("page"))
+func searchChairs(c echo.Context) error {
+	filter, err := parseChairSearchFilter(c)
 	if err != nil {
-		c.Logger().Infof("Invalid format page parameter : %v", err)
+		c.Echo().Logger.Infof("%v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	if filter.empty() {
+		c.Echo().Logger.Infof("Search condition not found")
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	perPage, err := strconv.Atoi(c.QueryParam("perPage"))
+	pagination, err := parsePagination(c)
 	if err != nil {
-		c.Logger().Infof("Invalid format perPage parameter : %v", err)
+		c.Logger().Infof("Invalid pagination parameter : %v", err)
 		return c.NoContent(http.StatusBadRequest)
 	}
 
+	var res ChairSearchResponse
+	var ok bool
+	res.Count, res.Chairs, ok = chairCache.Search(filter, pagination)
+	if !ok {
+		res.Count, res.Chairs, err = searchChairsSQL(filter, pagination)
+		if err != nil {
+			c.Logger().Errorf("searchChairs DB execution error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	if len(res.Chairs) > 0 {
+		last := res.Chairs[len(res.Chairs)-1]
+		res.NextCursor = pagination.NextCursor(len(res.Chairs), Cursor{Popularity: last.Popularity, ID: last.ID})
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// searchChairsSQL filter に一致する椅子の総数と指定ページの椅子を DB から取得する
+func searchChairsSQL(filter ChairSearchFilter, pagination Pagination) (int64, []Chair, error) {
 	searchQuery := "SELECT id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock FROM chair WHERE "
 	countQuery := "SELECT COUNT(1) FROM chair WHERE "
-	searchCondition := strings.Join(conditions, " AND ")
-	limitOffset := " ORDER BY popularity DESC, id ASC LIMIT ? OFFSET ?"
+	searchCondition, params := filter.sql()
+	orderBy := " ORDER BY popularity DESC, id ASC"
 
-	var res ChairSearchResponse
-	err = db.Get(&res.Count, countQuery+searchCondition, params...)
+	var count int64
+	err := db.Get(&count, countQuery+searchCondition, params...)
 	if err != nil {
-		c.Logger().Errorf("searchChairs DB execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return 0, nil, err
 	}
 
 	chairs := []Chair{}
-	params = append(params, perPage, page*perPage)
-	err = db.Select(&chairs, searchQuery+searchCondition+limitOffset, params...)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return c.JSON(http.StatusOK, ChairSearchResponse{Count: 0, Chairs: []Chair{}})
-		}
-		c.Logger().Errorf("searchChairs DB execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+	keyset, params := pagination.KeysetSQL(params)
+	limitOffset, params := pagination.SQL(params)
+	err = db.Select(&chairs, searchQuery+searchCondition+keyset+orderBy+limitOffset, params...)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, nil, err
 	}
-
-	res.Chairs = chairs
-
-	return c.JSON(http.StatusOK, res)
+	return count, chairs, nil
 }
 
 func buyChair(c echo.Context) error {
@@ -236,8 +387,8 @@ func buyChair(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	_, ok := m["email"].(string)
-	if !ok {
+	email, ok := m["email"].(string)
+	if !ok || email == "" {
 		c.Echo().Logger.Info("post buy chair failed : email not found in request body")
 		return c.NoContent(http.StatusBadRequest)
 	}
@@ -255,30 +406,148 @@ func buyChair(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	order, err := sellChair(tx, int64(id), email, 1, false)
+	if err == errChairSoldOut {
+		c.Echo().Logger.Infof("buyChair chair id \"%v\" not found", id)
+		return c.NoContent(http.StatusNotFound)
+	}
+	if err != nil {
+		c.Echo().Logger.Errorf("buyChair DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	body, err := saveIdempotentJSON(c, tx, http.StatusOK, order)
+	if err != nil {
+		c.Echo().Logger.Errorf("buyChair idempotency key update failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = commitChairStock(tx, func() { chairCache.DecrementStock(order.ChairID, 1) })
+	if err != nil {
+		c.Echo().Logger.Errorf("transaction commit error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSONBlob(http.StatusOK, body)
+}
+
+// errChairSoldOut 椅子が無いか、在庫が足りない
+var errChairSoldOut = errors.New("chair sold out")
+
+// sellChair chair を quantity 個売って購入記録を残す
+// reserved なら予約の時点で在庫を減らしてあるので、購入記録だけを残す
+func sellChair(tx *sqlx.Tx, id int64, email string, quantity int64, reserved bool) (ChairOrder, error) {
+	if !reserved {
+		// 在庫の確認と更新を1つの UPDATE で行い、行ロックはトランザクションの終わりまでしか持たない
+		sold, err := decrementChairStock(tx, id, quantity)
+		if err != nil {
+			return ChairOrder{}, err
+		}
+		if !sold {
+			return ChairOrder{}, errChairSoldOut
+		}
+	}
+
 	var chair Chair
-	err = tx.QueryRowx("SELECT id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock FROM chair WHERE id = ? AND stock_flag = TRUE FOR UPDATE", id).StructScan(&chair)
+	err := tx.Get(&chair, "SELECT id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock FROM chair WHERE id = ?", id)
+	if err == sql.ErrNoRows {
+		return ChairOrder{}, errChairSoldOut
+	}
+	if err != nil {
+		return ChairOrder{}, err
+	}
+	return insertChairOrder(tx, &chair, email, quantity)
+}
+
+// decrementChairStock 在庫が quantity 個以上あるときだけ売り、売れたかどうかを返す
+// UPDATE の条件で在庫を確かめるので、同時に買われても在庫がマイナスにならない
+// stock_flag は MySQL が SET を左から順に評価するので、減らした後の stock で決まる
+func decrementChairStock(tx *sqlx.Tx, id int64, quantity int64) (bool, error) {
+	res, err := tx.Exec("UPDATE chair SET stock = stock - ?, stock_flag = stock > 0 WHERE id = ? AND stock >= ?", quantity, id, quantity)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// checkChairRangeIDs 保存されている price_range_id, height_range_id が chair_condition.json と食い違う行を報告する
+func checkChairRangeIDs(logger echo.Logger) error {
+	rows := []struct {
+		ID            int64 `db:"id"`
+		Price         int64 `db:"price"`
+		Height        int64 `db:"height"`
+		PriceRangeID  int64 `db:"price_range_id"`
+		HeightRangeID int64 `db:"height_range_id"`
+	}{}
+	err := db.Select(&rows, "SELECT id, price, height, price_range_id, height_range_id FROM chair")
+	if err != nil {
+		return err
+	}
+
+	mismatches := 0
+	for _, row := range rows {
+		priceRangeID := rangeID(chairSearchCondition.Price, row.Price)
+		heightRangeID := rangeID(chairSearchCondition.Height, row.Height)
+		if row.PriceRangeID == priceRangeID && row.HeightRangeID == heightRangeID {
+			continue
+		}
+		mismatches++
+		if mismatches <= maxReportedRangeIDMismatches {
+			logger.Warnf("chair id %v range id mismatch : price_range_id %v (expected %v), height_range_id %v (expected %v)",
+				row.ID, row.PriceRangeID, priceRangeID, row.HeightRangeID, heightRangeID)
+		}
+	}
+	if mismatches > 0 {
+		logger.Warnf("%v of %v chairs have range ids inconsistent with chair_condition.json", mismatches, len(rows))
+	}
+	return nil
+}
+
+func searchRecommendedChairWithEstate(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("estateId"))
+	if err != nil {
+		c.Logger().Infof("Invalid format searchRecommendedChairWithEstate id : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	var estate Estate
+	err = db.Get(&estate, "SELECT id, thumbnail, name, description, latitude, longitude, address, rent, door_height, door_width, features, popularity FROM estate WHERE id = ?", id)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			c.Echo().Logger.Infof("buyChair chair id \"%v\" not found", id)
+			c.Logger().Infof("Requested estate id \"%v\" not found", id)
 			return c.NoContent(http.StatusNotFound)
 		}
-		c.Echo().Logger.Errorf("DB Execution Error: on getting a chair by id : %v", err)
+		c.Logger().Errorf("Database execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	_, err = tx.Exec("UPDATE chair SET stock = ?, stock_flag = ? > 0 WHERE id = ?", chair.Stock-1, chair.Stock-1, id)
+	filter, err := parseChairSearchFilter(c)
 	if err != nil {
-		c.Echo().Logger.Errorf("chair stock update failed : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		c.Echo().Logger.Infof("%v", err)
+		return c.NoContent(http.StatusBadRequest)
 	}
 
-	err = tx.Commit()
+	opt, err := parseFitOptions(c)
 	if err != nil {
-		c.Echo().Logger.Errorf("transaction commit error : %v", err)
+		c.Logger().Infof("searchRecommendedChairWithEstate %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	if chairs, ok := chairCache.RecommendedFor(estate, filter, opt, Limit); ok {
+		return c.JSON(http.StatusOK, RecommendedChairResponse{Chairs: chairs})
+	}
+
+	chairs, err := recommendedChairsSQL(estate, filter, opt, Limit)
+	if err != nil {
+		c.Logger().Errorf("Database execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	return c.NoContent(http.StatusOK)
+	return c.JSON(http.StatusOK, RecommendedChairResponse{Chairs: chairs})
 }
 
 func getChairSearchCondition(c echo.Context) error {
@@ -286,6 +555,10 @@ func getChairSearchCondition(c echo.Context) error {
 }
 
 func getLowPricedChair(c echo.Context) error {
+	if chairs, ok := chairCache.LowPriced(Limit); ok {
+		return c.JSON(http.StatusOK, ChairListResponse{Chairs: chairs})
+	}
+
 	var chairs []Chair
 	query := `SELECT id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock FROM chair WHERE stock_flag = TRUE ORDER BY price ASC, id ASC LIMIT ?`
 	err := db.Select(&chairs, query, Limit)
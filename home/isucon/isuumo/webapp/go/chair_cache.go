@@ -0,0 +1,345 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ChairSearchFilter searchChairsの検索条件
+type ChairSearchFilter struct {
+	Price    *Range
+	Height   *Range
+	Width    *Range
+	Depth    *Range
+	Kind     string
+	Color    string
+	Features []string
+}
+
+func (f ChairSearchFilter) empty() bool {
+	return f.Price == nil && f.Height == nil && f.Width == nil && f.Depth == nil && f.Kind == "" && f.Color == "" && len(f.Features) == 0
+}
+
+// sql 検索用の条件、在庫のある椅子だけに絞る
+func (f ChairSearchFilter) sql() (string, []interface{}) {
+	conditions, params := f.conditions()
+	conditions = append(conditions, "stock_flag = TRUE")
+	return strings.Join(conditions, " AND "), params
+}
+
+// exportSQL 書き出し用の条件、在庫切れの椅子も含める
+func (f ChairSearchFilter) exportSQL() (string, []interface{}) {
+	conditions, params := f.conditions()
+	if len(conditions) == 0 {
+		return "TRUE", params
+	}
+	return strings.Join(conditions, " AND "), params
+}
+
+func (f ChairSearchFilter) conditions() ([]string, []interface{}) {
+	conditions := make([]string, 0)
+	params := make([]interface{}, 0)
+
+	if f.Price != nil {
+		conditions = append(conditions, "price_range_id = ?")
+		params = append(params, f.Price.ID)
+	}
+
+	if f.Height != nil {
+		conditions = append(conditions, "height_range_id = ?")
+		params = append(params, f.Height.ID)
+	}
+
+	if f.Width != nil {
+		if f.Width.Min != -1 {
+			conditions = append(conditions, "width >= ?")
+			params = append(params, f.Width.Min)
+		}
+		if f.Width.Max != -1 {
+			conditions = append(conditions, "width < ?")
+			params = append(params, f.Width.Max)
+		}
+	}
+
+	if f.Depth != nil {
+		if f.Depth.Min != -1 {
+			conditions = append(conditions, "depth >= ?")
+			params = append(params, f.Depth.Min)
+		}
+		if f.Depth.Max != -1 {
+			conditions = append(conditions, "depth < ?")
+			params = append(params, f.Depth.Max)
+		}
+	}
+
+	if f.Kind != "" {
+		conditions = append(conditions, "kind = ?")
+		params = append(params, f.Kind)
+	}
+
+	if f.Color != "" {
+		conditions = append(conditions, "color = ?")
+		params = append(params, f.Color)
+	}
+
+	for _, feature := range f.Features {
+		conditions = append(conditions, "features LIKE CONCAT('%', ?, '%')")
+		params = append(params, feature)
+	}
+
+	return conditions, params
+}
+
+func inRange(r *Range, v int64) bool {
+	return r == nil || ((r.Min == -1 || r.Min <= v) && (r.Max == -1 || v < r.Max))
+}
+
+func (f ChairSearchFilter) match(chair *Chair) bool {
+	if chair.Stock <= 0 {
+		return false
+	}
+	if !inRange(f.Price, chair.Price) || !inRange(f.Height, chair.Height) || !inRange(f.Width, chair.Width) || !inRange(f.Depth, chair.Depth) {
+		return false
+	}
+	if f.Kind != "" && chair.Kind != f.Kind {
+		return false
+	}
+	if f.Color != "" && chair.Color != f.Color {
+		return false
+	}
+	for _, feature := range f.Features {
+		if !strings.Contains(chair.Features, feature) {
+			return false
+		}
+	}
+	return true
+}
+
+// ChairCache 在庫切れを含む全ての椅子を保持し、在庫があるものだけを返す
+type ChairCache struct {
+	mu           sync.RWMutex
+	loaded       bool
+	chairs       map[int64]*Chair
+	byPopularity []*Chair
+	byPrice      []*Chair
+}
+
+var chairCache = &ChairCache{}
+
+// chairCommitMu 椅子のコミットとキャッシュへの反映を、コミットと同じ順に行うためのロック
+// 在庫を上書きする登録や削除は排他で取り、在庫の増減は順序が入れ替わっても同じ結果になるので共有で取る
+var chairCommitMu sync.RWMutex
+
+// commitChairCache 登録や削除をコミットし、apply でキャッシュに反映する
+func commitChairCache(tx committer, apply func()) error {
+	chairCommitMu.Lock()
+	defer chairCommitMu.Unlock()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// commitChairStock 在庫の増減をコミットし、apply でキャッシュに反映する
+func commitChairStock(tx committer, apply func()) error {
+	chairCommitMu.RLock()
+	defer chairCommitMu.RUnlock()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+func updateChairCache() error {
+	chairCommitMu.Lock()
+	defer chairCommitMu.Unlock()
+
+	chairs := []Chair{}
+	err := db.Select(&chairs, "SELECT id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock FROM chair")
+	if err != nil {
+		return err
+	}
+	chairCache.Load(chairs)
+	return nil
+}
+
+func (cc *ChairCache) Load(chairs []Chair) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.loaded = true
+	cc.chairs = make(map[int64]*Chair, len(chairs))
+	cc.byPopularity = make([]*Chair, 0, len(chairs))
+	cc.byPrice = make([]*Chair, 0, len(chairs))
+	cc.add(chairs)
+}
+
+// Add 登録された椅子を追加する
+func (cc *ChairCache) Add(chairs []Chair) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if !cc.loaded {
+		return
+	}
+	cc.add(chairs)
+}
+
+// add 既にある id の椅子は上書きする
+func (cc *ChairCache) add(chairs []Chair) {
+	for i := range chairs {
+		chair := chairs[i]
+		if existing, ok := cc.chairs[chair.ID]; ok {
+			*existing = chair
+			continue
+		}
+		cc.chairs[chair.ID] = &chair
+		cc.byPopularity = append(cc.byPopularity, &chair)
+		cc.byPrice = append(cc.byPrice, &chair)
+	}
+	cc.sort()
+}
+
+func (cc *ChairCache) sort() {
+	sort.Slice(cc.byPopularity, func(i, j int) bool {
+		if cc.byPopularity[i].Popularity == cc.byPopularity[j].Popularity {
+			return cc.byPopularity[i].ID < cc.byPopularity[j].ID
+		}
+		return cc.byPopularity[i].Popularity > cc.byPopularity[j].Popularity
+	})
+	sort.Slice(cc.byPrice, func(i, j int) bool {
+		if cc.byPrice[i].Price == cc.byPrice[j].Price {
+			return cc.byPrice[i].ID < cc.byPrice[j].ID
+		}
+		return cc.byPrice[i].Price < cc.byPrice[j].Price
+	})
+}
+
+func (cc *ChairCache) Delete(id int64) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	chair, ok := cc.chairs[id]
+	if !ok {
+		return
+	}
+	delete(cc.chairs, id)
+	cc.byPopularity = removeChair(cc.byPopularity, chair)
+	cc.byPrice = removeChair(cc.byPrice, chair)
+}
+
+func removeChair(chairs []*Chair, chair *Chair) []*Chair {
+	for i, c := range chairs {
+		if c == chair {
+			return append(chairs[:i], chairs[i+1:]...)
+		}
+	}
+	return chairs
+}
+
+// DecrementStock コミット済みの購入を反映する
+// 購入のコミット順とキャッシュへの反映順が前後しても同じ結果になるように差分で更新する
+func (cc *ChairCache) DecrementStock(id int64, quantity int64) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if chair, ok := cc.chairs[id]; ok {
+		chair.Stock -= quantity
+	}
+}
+
+// IncrementStock 期限切れで解放された予約を在庫に戻す
+func (cc *ChairCache) IncrementStock(id int64, quantity int64) {
+	cc.DecrementStock(id, -quantity)
+}
+
+// Get 在庫のある椅子を返す ok はキャッシュが読み込み済みかどうか
+func (cc *ChairCache) Get(id int64) (chair Chair, found bool, ok bool) {
+	chair, found, ok = cc.Lookup(id)
+	if found && chair.Stock <= 0 {
+		return Chair{}, false, ok
+	}
+	return chair, found, ok
+}
+
+// Lookup 在庫切れも含めて椅子を返す ok はキャッシュが読み込み済みかどうか
+func (cc *ChairCache) Lookup(id int64) (chair Chair, found bool, ok bool) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	if !cc.loaded {
+		return Chair{}, false, false
+	}
+	c, found := cc.chairs[id]
+	if !found {
+		return Chair{}, false, true
+	}
+	return *c, true, true
+}
+
+func (cc *ChairCache) Search(f ChairSearchFilter, p Pagination) (count int64, chairs []Chair, ok bool) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	if !cc.loaded {
+		return 0, nil, false
+	}
+	chairs = []Chair{}
+	offset := p.Offset()
+	for _, chair := range cc.byPopularity {
+		if !f.match(chair) {
+			continue
+		}
+		count++
+		if p.After != nil && p.After.Less(chair.Popularity, chair.ID) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if len(chairs) < p.Limit() {
+			chairs = append(chairs, *chair)
+		}
+	}
+	return count, chairs, true
+}
+
+func (cc *ChairCache) LowPriced(limit int) ([]Chair, bool) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	if !cc.loaded {
+		return nil, false
+	}
+	chairs := make([]Chair, 0, limit)
+	for _, chair := range cc.byPrice {
+		if len(chairs) >= limit {
+			break
+		}
+		if chair.Stock > 0 {
+			chairs = append(chairs, *chair)
+		}
+	}
+	return chairs, true
+}
+
+// RecommendedFor 物件のドアを通る在庫のある椅子を popularity DESC, id ASC で limit 件まで返す
+func (cc *ChairCache) RecommendedFor(estate Estate, f ChairSearchFilter, opt FitOptions, limit int) ([]RecommendedChair, bool) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	if !cc.loaded {
+		return nil, false
+	}
+	chairs := []RecommendedChair{}
+	for _, chair := range cc.byPopularity {
+		if !f.match(chair) {
+			continue
+		}
+		fit, ok := fitThroughDoor(*chair, estate.DoorWidth, estate.DoorHeight, opt)
+		if !ok {
+			continue
+		}
+		chairs = append(chairs, RecommendedChair{Chair: *chair, Fits: fit})
+		if len(chairs) >= limit {
+			break
+		}
+	}
+	return chairs, true
+}
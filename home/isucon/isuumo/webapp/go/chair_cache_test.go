@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestChairCacheSoldOut(t *testing.T) {
+	cache := &ChairCache{}
+	cache.Load([]Chair{{ID: 1, Stock: 1}, {ID: 2, Stock: 0}})
+
+	if _, found, ok := cache.Get(2); !ok || found {
+		t.Errorf("Get(2) found a sold out chair")
+	}
+	if chair, found, ok := cache.Lookup(2); !ok || !found || chair.ID != 2 {
+		t.Errorf("Lookup(2) = %+v, %v, %v", chair, found, ok)
+	}
+
+	cache.DecrementStock(1, 1)
+	if _, found, _ := cache.Get(1); found {
+		t.Errorf("Get(1) found a chair after its last unit was sold")
+	}
+	if _, found, _ := cache.Lookup(1); !found {
+		t.Errorf("Lookup(1) lost a sold out chair")
+	}
+	if _, found, ok := cache.Lookup(3); !ok || found {
+		t.Errorf("Lookup(3) found a missing chair")
+	}
+}
+
+func TestChairSearchFilterExportSQL(t *testing.T) {
+	filter := ChairSearchFilter{Kind: "座椅子", Features: []string{"リクライニング"}}
+	condition, params := filter.exportSQL()
+	if want := "kind = ? AND features LIKE CONCAT('%', ?, '%')"; condition != want {
+		t.Errorf("exportSQL() = %q, want %q", condition, want)
+	}
+	if len(params) != 2 {
+		t.Errorf("exportSQL() params = %v", params)
+	}
+	if condition, _ := (ChairSearchFilter{}).exportSQL(); condition != "TRUE" {
+		t.Errorf("empty exportSQL() = %q, want TRUE", condition)
+	}
+	if condition, _ := filter.sql(); condition != "kind = ? AND features LIKE CONCAT('%', ?, '%') AND stock_flag = TRUE" {
+		t.Errorf("sql() = %q", condition)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	CheckoutReasonNotFound   = "not found"
+	CheckoutReasonOutOfStock = "out of stock"
+)
+
+type CheckoutItem struct {
+	ChairID  int64 `json:"chairId"`
+	Quantity int64 `json:"quantity"`
+}
+
+type CheckoutRequest struct {
+	Email string         `json:"email"`
+	Items []CheckoutItem `json:"items"`
+}
+
+// CheckoutLine 買えなかった行の理由、Reason が空なら買える
+type CheckoutLine struct {
+	ChairID   int64  `json:"chairId"`
+	Quantity  int64  `json:"quantity"`
+	Available int64  `json:"available"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+type CheckoutResponse struct {
+	Orders []ChairOrder   `json:"orders,omitempty"`
+	Lines  []CheckoutLine `json:"lines,omitempty"`
+}
+
+func (r CheckoutRequest) validate() error {
+	if r.Email == "" {
+		return fmt.Errorf("email not found in request body")
+	}
+	if len(r.Items) == 0 {
+		return fmt.Errorf("items is empty")
+	}
+	seen := map[int64]bool{}
+	for _, item := range r.Items {
+		if item.Quantity <= 0 {
+			return fmt.Errorf("chair %v : quantity must be positive : %v", item.ChairID, item.Quantity)
+		}
+		if seen[item.ChairID] {
+			return fmt.Errorf("chair %v : duplicated in items", item.ChairID)
+		}
+		seen[item.ChairID] = true
+	}
+	return nil
+}
+
+// checkoutChairs 全ての行を買うか、1つも買わずに行ごとの理由を返す
+// デッドロックを避けるため、行ロックは常に id の昇順で取る
+func checkoutChairs(c echo.Context) error {
+	var req CheckoutRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Infof("checkoutChairs : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if err := req.validate(); err != nil {
+		c.Logger().Infof("checkoutChairs : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	items := make([]CheckoutItem, len(req.Items))
+	copy(items, req.Items)
+	sort.Slice(items, func(i, j int) bool { return items[i].ChairID < items[j].ChairID })
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("failed to create transaction : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	chairs := make(map[int64]*Chair, len(items))
+	lines := make(map[int64]CheckoutLine, len(items))
+	failed := false
+	for _, item := range items {
+		line := CheckoutLine{ChairID: item.ChairID, Quantity: item.Quantity}
+		var chair Chair
+		err := tx.QueryRowx("SELECT id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock FROM chair WHERE id = ? FOR UPDATE", item.ChairID).StructScan(&chair)
+		switch {
+		case err == sql.ErrNoRows:
+			line.Reason = CheckoutReasonNotFound
+		case err != nil:
+			c.Logger().Errorf("checkoutChairs DB execution error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		default:
+			line.Available = chair.Stock
+			if chair.Stock < item.Quantity {
+				line.Reason = CheckoutReasonOutOfStock
+			}
+			chairs[chair.ID] = &chair
+		}
+		if line.Reason != "" {
+			failed = true
+		}
+		lines[item.ChairID] = line
+	}
+
+	var res CheckoutResponse
+	if failed {
+		for _, item := range req.Items {
+			res.Lines = append(res.Lines, lines[item.ChairID])
+		}
+		c.Logger().Infof("checkoutChairs rejected : %+v", res.Lines)
+		return c.JSON(http.StatusConflict, res)
+	}
+
+	for _, item := range items {
+		sold, err := decrementChairStock(tx, item.ChairID, item.Quantity)
+		if err != nil {
+			c.Logger().Errorf("chair stock update failed : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if !sold {
+			c.Logger().Errorf("chair %v : stock changed while locked", item.ChairID)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	for _, item := range req.Items {
+		order, err := insertChairOrder(tx, chairs[item.ChairID], req.Email, item.Quantity)
+		if err != nil {
+			c.Logger().Errorf("chair order insert failed : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		res.Orders = append(res.Orders, order)
+	}
+
+	body, err := saveIdempotentJSON(c, tx, http.StatusOK, res)
+	if err != nil {
+		c.Logger().Errorf("checkoutChairs idempotency key update failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = commitChairStock(tx, func() {
+		for _, item := range items {
+			chairCache.DecrementStock(item.ChairID, item.Quantity)
+		}
+	})
+	if err != nil {
+		c.Logger().Errorf("transaction commit error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSONBlob(http.StatusOK, body)
+}
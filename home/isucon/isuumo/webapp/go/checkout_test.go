@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+// TestConcurrentBuy buyChair と checkoutChairs が同じ椅子を同時に買っても、在庫の数だけが売れることを確かめる
+func TestConcurrentBuy(t *testing.T) {
+	openTestDB(t)
+	const stock, buyers = 5, 20
+
+	chair := testChairs(1)[0]
+	chair.Stock = stock
+	insertTestChairs(t, []Chair{chair})
+	if err := updateChairCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	codes := make(chan int, buyers)
+	var wg sync.WaitGroup
+	for i := 0; i < buyers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			email := fmt.Sprintf("buyer%d@example.com", i)
+			var req *http.Request
+			var handler echo.HandlerFunc
+			if i%2 == 0 {
+				req = httptest.NewRequest(http.MethodPost, "/api/chair/buy/"+fmt.Sprint(chair.ID), strings.NewReader(`{"email":"`+email+`"}`))
+				handler = buyChair
+			} else {
+				req = httptest.NewRequest(http.MethodPost, "/api/chair/checkout", strings.NewReader(fmt.Sprintf(`{"email":%q,"items":[{"chairId":%d,"quantity":1}]}`, email, chair.ID)))
+				handler = checkoutChairs
+			}
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetParamNames("id")
+			c.SetParamValues(fmt.Sprint(chair.ID))
+			if err := handler(c); err != nil {
+				t.Error(err)
+			}
+			codes <- rec.Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	sold := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			sold++
+		case http.StatusNotFound, http.StatusConflict:
+		default:
+			t.Errorf("unexpected status %v", code)
+		}
+	}
+	if sold != stock {
+		t.Errorf("%v purchases succeeded, want %v", sold, stock)
+	}
+
+	var left int64
+	if err := db.Get(&left, "SELECT stock FROM chair WHERE id = ?", chair.ID); err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Errorf("stock = %v, want 0", left)
+	}
+	var orders int
+	if err := db.Get(&orders, "SELECT COUNT(*) FROM chair_order WHERE chair_id = ?", chair.ID); err != nil {
+		t.Fatal(err)
+	}
+	if orders != stock {
+		t.Errorf("%v chair_order rows, want %v", orders, stock)
+	}
+	if cached, found, _ := chairCache.Lookup(chair.ID); !found || cached.Stock != 0 {
+		t.Errorf("cached chair = %+v, %v, want stock 0", cached, found)
+	}
+}
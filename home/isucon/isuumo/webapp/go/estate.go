@@ -1,8 +1,9 @@
 package main
 
 import (
-	"fmt"
 	"net/http"
+	"sync"
+	"sync/atomic"
 
 	"github.com/labstack/echo"
 )
@@ -23,27 +24,135 @@ type EstateCache struct {
 	RentCategory int64   `db:"rent_category" json:"-"`
 }
 
-var estateCache []EstateCache
-
-func listEstatesInPolygon(c echo.Context, coordinates Coordinates) ([]Estate, error) {
-	estates := []Estate{}
-	query := fmt.Sprintf(
-		`SELECT estate.id, estate.thumbnail, estate.name, estate.description, estate.latitude, estate.longitude, estate.address, estate.rent, estate.door_height, estate.door_width, estate.features, estate.popularity FROM estate JOIN estate_location ON estate.id = estate_location.id WHERE ST_Contains(ST_PolygonFromText(%s), estate_location.location) ORDER BY estate.popularity DESC, estate.id ASC`,
-		coordinates.coordinatesToText2(),
-	)
-	c.Echo().Logger.Infof("query = %q", query)
-	err := db.Select(&estates, query)
-	return estates, err
+// EstateSnapshot ある時点の estate テーブル全体と検索用インデックス
+// 公開後は変更しないので、読み出し側はロックなしで参照できる
+type EstateSnapshot struct {
+	Version int64
+	Estates []EstateCache
+	Index   *EstateIndex
+}
+
+// estateCache *EstateSnapshot を保持する
+var estateCache atomic.Value
+
+// estateCacheMu 再構築同士が古い内容で新しい内容を上書きしないようにするためのロック
+var estateCacheMu sync.Mutex
+
+func currentEstateCache() *EstateSnapshot {
+	snapshot, _ := estateCache.Load().(*EstateSnapshot)
+	return snapshot
+}
+
+func listEstatesInShape(shape Shape, filter EstateSearchFilter, pagination Pagination) (int64, []Estate, error) {
+	searchCondition, params := filter.sql()
+	searchCondition = "id IN (SELECT id FROM estate_location WHERE ST_Contains(ST_GeomFromText(?), location)) AND " + searchCondition
+	params = append([]interface{}{shape.wkt()}, params...)
+	return searchEstatesSQL(searchCondition, params, pagination)
 }
 
 func updateEstateCache() error {
-	estateCache = []EstateCache{}
-	err := db.Select(&estateCache, "SELECT id, thumbnail, name, description, latitude, longitude, address, rent, door_height, door_width, features, popularity, rent_category FROM estate")
-	return err
+	estateCacheMu.Lock()
+	defer estateCacheMu.Unlock()
+
+	estates := []EstateCache{}
+	err := db.Select(&estates, "SELECT id, thumbnail, name, description, latitude, longitude, address, rent, door_height, door_width, features, popularity, rent_category FROM estate")
+	if err != nil {
+		return err
+	}
+	publishEstateCache(estates)
+	return nil
+}
+
+// committer *sql.Tx と *sqlx.Tx
+type committer interface {
+	Commit() error
+}
+
+// commitEstateCache tx をコミットし、同じロックの中でキャッシュに反映する
+// ロックの外で反映すると、同じ物件への更新がコミットと逆の順に反映されることがある
+func commitEstateCache(tx committer, upserted []EstateCache, deleted []int64) error {
+	estateCacheMu.Lock()
+	defer estateCacheMu.Unlock()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	applyEstateCache(upserted, deleted)
+	return nil
+}
+
+// applyEstateCache コミット済みの登録、更新、削除だけを現在のスナップショットに反映する
+// estateCacheMu を取った状態で呼ぶ
+func applyEstateCache(upserted []EstateCache, deleted []int64) {
+	prev := currentEstateCache()
+	if prev == nil {
+		return
+	}
+
+	// 同じ id が複数回登録されていたら最後のものを使う
+	removed := make(map[int64]bool, len(upserted)+len(deleted))
+	rows := make([]EstateCache, 0, len(upserted))
+	for i := len(upserted) - 1; i >= 0; i-- {
+		if removed[upserted[i].ID] {
+			continue
+		}
+		removed[upserted[i].ID] = true
+		rows = append(rows, upserted[i])
+	}
+	for _, id := range deleted {
+		removed[id] = true
+	}
+
+	estates := make([]EstateCache, 0, len(prev.Estates)+len(rows))
+	for _, e := range prev.Estates {
+		if !removed[e.ID] {
+			estates = append(estates, e)
+		}
+	}
+	estates = append(estates, rows...)
+	estateCache.Store(&EstateSnapshot{
+		Version: prev.Version + 1,
+		Estates: estates,
+		Index:   prev.Index.Remove(removed).Insert(rows),
+	})
+}
+
+// publishEstateCache estateCacheMu を取った状態で呼ぶ
+func publishEstateCache(estates []EstateCache) {
+	var version int64
+	if prev := currentEstateCache(); prev != nil {
+		version = prev.Version
+	}
+	estateCache.Store(&EstateSnapshot{
+		Version: version + 1,
+		Estates: estates,
+		Index:   newEstateIndex(estates),
+	})
+}
+
+func reloadEstateCache(c echo.Context) error {
+	if err := updateEstateCache(); err != nil {
+		c.Logger().Errorf("updateEstateCache() : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, echo.Map{"version": currentEstateCache().Version})
+}
+
+// repairRentCategory 既存の行の rent_category を rentCategory と同じ基準で付け直す
+func repairRentCategory() (int64, error) {
+	caseExpr, params := rangeIDSQL(estateSearchCondition.Rent, "rent")
+	res, err := db.Exec("UPDATE estate SET rent_category = "+caseExpr, params...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
 
 func debugEstate(c echo.Context) error {
-	return c.JSON(http.StatusOK, estateCache)
+	snapshot := currentEstateCache()
+	if snapshot == nil {
+		return c.JSON(http.StatusOK, []EstateCache{})
+	}
+	return c.JSON(http.StatusOK, snapshot.Estates)
 }
 
 func (c *EstateCache) Estate() Estate {
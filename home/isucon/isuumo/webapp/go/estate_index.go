@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"strings"
+)
+
+type bitmap []uint64
+
+func newBitmap(n int) bitmap {
+	return make(bitmap, (n+63)/64)
+}
+
+func (b bitmap) set(i int) {
+	b[i>>6] |= 1 << uint(i&63)
+}
+
+func (b bitmap) clone() bitmap {
+	c := make(bitmap, len(b))
+	copy(c, b)
+	return c
+}
+
+func (b bitmap) and(o bitmap) {
+	for i := range b {
+		b[i] &= o[i]
+	}
+}
+
+func (b bitmap) or(o bitmap) {
+	for i := range b {
+		b[i] |= o[i]
+	}
+}
+
+// EstateSearchFilter searchEstatesの検索条件
+type EstateSearchFilter struct {
+	DoorHeight *Range
+	DoorWidth  *Range
+	Rent       *Range
+	Features   []string
+}
+
+func (f EstateSearchFilter) empty() bool {
+	return f.DoorHeight == nil && f.DoorWidth == nil && f.Rent == nil && len(f.Features) == 0
+}
+
+func (f EstateSearchFilter) sql() (string, []interface{}) {
+	conditions := make([]string, 0)
+	params := make([]interface{}, 0)
+
+	if f.DoorHeight != nil {
+		if f.DoorHeight.Min != -1 {
+			conditions = append(conditions, "door_height >= ?")
+			params = append(params, f.DoorHeight.Min)
+		}
+		if f.DoorHeight.Max != -1 {
+			conditions = append(conditions, "door_height < ?")
+			params = append(params, f.DoorHeight.Max)
+		}
+	}
+
+	if f.DoorWidth != nil {
+		if f.DoorWidth.Min != -1 {
+			conditions = append(conditions, "door_width >= ?")
+			params = append(params, f.DoorWidth.Min)
+		}
+		if f.DoorWidth.Max != -1 {
+			conditions = append(conditions, "door_width < ?")
+			params = append(params, f.DoorWidth.Max)
+		}
+	}
+
+	if f.Rent != nil {
+		if f.Rent.Min != -1 {
+			conditions = append(conditions, "rent >= ?")
+			params = append(params, f.Rent.Min)
+		}
+		if f.Rent.Max != -1 {
+			conditions = append(conditions, "rent < ?")
+			params = append(params, f.Rent.Max)
+		}
+	}
+
+	for _, feature := range f.Features {
+		conditions = append(conditions, "features like concat('%', ?, '%')")
+		params = append(params, feature)
+	}
+
+	if len(conditions) == 0 {
+		return "TRUE", params
+	}
+	return strings.Join(conditions, " AND "), params
+}
+
+// EstateIndex estateCacheを popularity DESC, id ASC に並べ、検索条件ごとのビットマップを持つ
+type EstateIndex struct {
+	estates  []EstateCache
+	all      bitmap
+	ranges   map[*Range]bitmap
+	features map[string]bitmap
+	grid     estateGrid
+}
+
+func lessEstate(a, b *EstateCache) bool {
+	if a.Popularity == b.Popularity {
+		return a.ID < b.ID
+	}
+	return a.Popularity > b.Popularity
+}
+
+func estateRangePredicates() map[*Range]func(e *EstateCache) bool {
+	predicates := map[*Range]func(e *EstateCache) bool{}
+	for _, r := range estateSearchCondition.DoorHeight.Ranges {
+		r := r
+		predicates[r] = func(e *EstateCache) bool { return inRange(r, e.DoorHeight) }
+	}
+	for _, r := range estateSearchCondition.DoorWidth.Ranges {
+		r := r
+		predicates[r] = func(e *EstateCache) bool { return inRange(r, e.DoorWidth) }
+	}
+	for _, r := range estateSearchCondition.Rent.Ranges {
+		r := r
+		predicates[r] = func(e *EstateCache) bool { return rentCategory(e.Rent) == r.ID }
+	}
+	return predicates
+}
+
+func newEstateIndex(cache []EstateCache) *EstateIndex {
+	return (&EstateIndex{}).Insert(cache)
+}
+
+// Insert 既存のビットマップを新しい並び順に移し替え、追加分だけを評価したインデックスを返す
+func (idx *EstateIndex) Insert(added []EstateCache) *EstateIndex {
+	rows := make([]EstateCache, len(added))
+	copy(rows, added)
+	sort.Slice(rows, func(i, j int) bool { return lessEstate(&rows[i], &rows[j]) })
+
+	estates := make([]EstateCache, 0, len(idx.estates)+len(rows))
+	oldPos := make([]int, len(idx.estates))
+	rowPos := make([]int, len(rows))
+	for i, j := 0, 0; i < len(idx.estates) || j < len(rows); {
+		if j == len(rows) || (i < len(idx.estates) && lessEstate(&idx.estates[i], &rows[j])) {
+			oldPos[i] = len(estates)
+			estates = append(estates, idx.estates[i])
+			i++
+		} else {
+			rowPos[j] = len(estates)
+			estates = append(estates, rows[j])
+			j++
+		}
+	}
+
+	remap := func(old bitmap, match func(e *EstateCache) bool) bitmap {
+		b := newBitmap(len(estates))
+		for w, x := range old {
+			for x != 0 {
+				b.set(oldPos[w<<6+bits.TrailingZeros64(x)])
+				x &= x - 1
+			}
+		}
+		for j := range rows {
+			if match(&rows[j]) {
+				b.set(rowPos[j])
+			}
+		}
+		return b
+	}
+
+	next := &EstateIndex{
+		estates:  estates,
+		all:      remap(idx.all, func(e *EstateCache) bool { return true }),
+		ranges:   map[*Range]bitmap{},
+		features: map[string]bitmap{},
+		grid:     newEstateGrid(estates),
+	}
+	for r, match := range estateRangePredicates() {
+		next.ranges[r] = remap(idx.ranges[r], match)
+	}
+	for _, f := range estateSearchCondition.Feature.List {
+		f := f
+		next.features[f] = remap(idx.features[f], func(e *EstateCache) bool { return strings.Contains(e.Features, f) })
+	}
+	return next
+}
+
+// Remove ids に含まれる物件を除いたインデックスを返す
+func (idx *EstateIndex) Remove(ids map[int64]bool) *EstateIndex {
+	estates := make([]EstateCache, 0, len(idx.estates))
+	newPos := make([]int, len(idx.estates))
+	for i := range idx.estates {
+		if ids[idx.estates[i].ID] {
+			newPos[i] = -1
+			continue
+		}
+		newPos[i] = len(estates)
+		estates = append(estates, idx.estates[i])
+	}
+	if len(estates) == len(idx.estates) {
+		return idx
+	}
+
+	remap := func(old bitmap) bitmap {
+		b := newBitmap(len(estates))
+		for w, x := range old {
+			for x != 0 {
+				if i := newPos[w<<6+bits.TrailingZeros64(x)]; i >= 0 {
+					b.set(i)
+				}
+				x &= x - 1
+			}
+		}
+		return b
+	}
+
+	next := &EstateIndex{
+		estates:  estates,
+		all:      remap(idx.all),
+		ranges:   make(map[*Range]bitmap, len(idx.ranges)),
+		features: make(map[string]bitmap, len(idx.features)),
+		grid:     newEstateGrid(estates),
+	}
+	for r, b := range idx.ranges {
+		next.ranges[r] = remap(b)
+	}
+	for f, b := range idx.features {
+		next.features[f] = remap(b)
+	}
+	return next
+}
+
+func (idx *EstateIndex) scanFeature(feature string) bitmap {
+	b := newBitmap(len(idx.estates))
+	for i := range idx.estates {
+		if strings.Contains(idx.estates[i].Features, feature) {
+			b.set(i)
+		}
+	}
+	return b
+}
+
+func (idx *EstateIndex) rangeBitmap(r *Range) (bitmap, error) {
+	b, ok := idx.ranges[r]
+	if !ok {
+		return nil, fmt.Errorf("range %v is not indexed", r.ID)
+	}
+	return b, nil
+}
+
+func (idx *EstateIndex) match(f EstateSearchFilter) (bitmap, error) {
+	acc := idx.all.clone()
+	for _, r := range []*Range{f.DoorHeight, f.DoorWidth, f.Rent} {
+		if r == nil {
+			continue
+		}
+		b, err := idx.rangeBitmap(r)
+		if err != nil {
+			return nil, err
+		}
+		acc.and(b)
+	}
+	for _, feature := range f.Features {
+		b, ok := idx.features[feature]
+		if !ok {
+			b = idx.scanFeature(feature)
+		}
+		acc.and(b)
+	}
+	return acc, nil
+}
+
+// Search 条件に一致する物件の総数と指定ページの物件を返す
+func (idx *EstateIndex) Search(f EstateSearchFilter, p Pagination) (int64, []Estate, error) {
+	acc, err := idx.match(f)
+	if err != nil {
+		return 0, nil, err
+	}
+	count, estates := idx.page(acc, p)
+	return count, estates, nil
+}
+
+// page acc に含まれる物件の総数と指定ページの物件
+func (idx *EstateIndex) page(acc bitmap, p Pagination) (int64, []Estate) {
+	offset, limit := p.Offset(), p.Limit()
+	start := 0
+	if p.After != nil {
+		start = sort.Search(len(idx.estates), func(i int) bool {
+			return !p.After.Less(idx.estates[i].Popularity, idx.estates[i].ID)
+		})
+	}
+
+	estates := []Estate{}
+	count := 0
+	for w, x := range acc {
+		if w<<6+64 <= start {
+			count += bits.OnesCount64(x)
+			offset += bits.OnesCount64(x)
+			continue
+		}
+		if w<<6 < start {
+			skipped := x & (1<<uint(start-w<<6) - 1)
+			offset += bits.OnesCount64(skipped)
+		}
+		n := bits.OnesCount64(x)
+		if count+n <= offset || len(estates) >= limit {
+			count += n
+			continue
+		}
+		for x != 0 {
+			i := w<<6 + bits.TrailingZeros64(x)
+			x &= x - 1
+			if count >= offset && len(estates) < limit {
+				estates = append(estates, idx.estates[i].Estate())
+			}
+			count++
+		}
+	}
+	return int64(count), estates
+}
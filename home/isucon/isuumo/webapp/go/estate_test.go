@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func publishTestEstates(t *testing.T, estates []EstateCache) {
+	estateCacheMu.Lock()
+	publishEstateCache(estates)
+	estateCacheMu.Unlock()
+	t.Cleanup(func() { estateCache.Store((*EstateSnapshot)(nil)) })
+}
+
+// TestApplyEstateCacheConcurrentSearch go test -race で、登録や削除の反映中に検索しても壊れたスナップショットが見えないことを確かめる
+func TestApplyEstateCacheConcurrentSearch(t *testing.T) {
+	estates := testEstates(400)
+	publishTestEstates(t, estates[:200])
+
+	filter := EstateSearchFilter{Rent: estateSearchCondition.Rent.Ranges[1]}
+	pagination, _ := newPagination(0, MaxPerPage)
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	errs := make(chan string, 12)
+	for r := 0; r < 8; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			var version int64
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				snapshot := currentEstateCache()
+				if snapshot.Version < version {
+					errs <- "snapshot version went backwards"
+					return
+				}
+				version = snapshot.Version
+				count, got, err := snapshot.Index.Search(filter, pagination)
+				if err != nil {
+					errs <- err.Error()
+					return
+				}
+				if int(count) < len(got) {
+					errs <- "count is smaller than the page"
+					return
+				}
+				for i := range got {
+					if rentCategory(got[i].Rent) != filter.Rent.ID {
+						errs <- "search returned an estate outside the rent range"
+						return
+					}
+					if i > 0 && (Cursor{Popularity: got[i-1].Popularity, ID: got[i-1].ID}).Less(got[i].Popularity, got[i].ID) {
+						errs <- "search results are out of order"
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	var writers sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for i := 200 + w; i < len(estates); i += 4 {
+				updated := estates[i-200]
+				updated.Popularity++
+				if err := commitEstateCache(testCommitter{}, []EstateCache{estates[i], updated}, []int64{estates[i-100].ID}); err != nil {
+					errs <- err.Error()
+					return
+				}
+			}
+		}(w)
+	}
+	writers.Wait()
+	close(done)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	final := currentEstateCache()
+	rebuilt := newEstateIndex(final.Estates)
+	for _, p := range []Pagination{{PerPage: MaxPerPage}, {Page: 1, PerPage: MaxPerPage}} {
+		wantCount, want, _ := rebuilt.Search(filter, p)
+		count, got, _ := final.Index.Search(filter, p)
+		if count != wantCount || !reflect.DeepEqual(got, want) {
+			t.Errorf("incremental index diverged from a rebuild: %v %v, want %v %v", count, got, wantCount, want)
+		}
+	}
+}
+
+// testCommitter err を Commit の結果として返す
+type testCommitter struct {
+	err error
+}
+
+func (c testCommitter) Commit() error {
+	return c.err
+}
+
+func TestCommitEstateCacheFailedCommit(t *testing.T) {
+	estates := testEstates(10)
+	publishTestEstates(t, estates[:5])
+	before := currentEstateCache()
+
+	err := commitEstateCache(testCommitter{err: errors.New("commit failed")}, estates[5:], []int64{estates[0].ID})
+	if err == nil {
+		t.Fatal("commitEstateCache returned no error")
+	}
+	if currentEstateCache() != before {
+		t.Error("a failed commit was applied to the cache")
+	}
+
+	if err := commitEstateCache(testCommitter{}, estates[5:], []int64{estates[0].ID}); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(currentEstateCache().Estates); got != 9 {
+		t.Errorf("cache has %v estates, want 9", got)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	ExportFormatCSV    = "csv"
+	ExportFormatNDJSON = "ndjson"
+)
+
+// exportWriter postEstate / postChair がそのまま読める形式で1行ずつ書き出す
+type exportWriter interface {
+	Write(record []string) error
+	Flush() error
+}
+
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func (w *csvExportWriter) Write(record []string) error {
+	return w.w.Write(record)
+}
+
+func (w *csvExportWriter) Flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+type ndjsonExportWriter struct {
+	w       *bufio.Writer
+	columns []CSVColumn
+}
+
+func (w *ndjsonExportWriter) Write(record []string) error {
+	w.w.WriteByte('{')
+	for i, column := range w.columns {
+		if i > 0 {
+			w.w.WriteByte(',')
+		}
+		key, _ := json.Marshal(column.jsonKey())
+		w.w.Write(key)
+		w.w.WriteByte(':')
+		if column.Number {
+			w.w.WriteString(record[i])
+			continue
+		}
+		value, err := json.Marshal(record[i])
+		if err != nil {
+			return err
+		}
+		w.w.Write(value)
+	}
+	w.w.WriteByte('}')
+	_, err := w.w.WriteString("\n")
+	return err
+}
+
+func (w *ndjsonExportWriter) Flush() error {
+	return w.w.Flush()
+}
+
+func parseExportFormat(c echo.Context) (string, error) {
+	format := c.QueryParam("format")
+	if format == "" {
+		if c.Request().Header.Get(echo.HeaderAccept) == MIMEApplicationNDJSON {
+			return ExportFormatNDJSON, nil
+		}
+		return ExportFormatCSV, nil
+	}
+	if format != ExportFormatCSV && format != ExportFormatNDJSON {
+		return "", fmt.Errorf("format must be %q or %q : %v", ExportFormatCSV, ExportFormatNDJSON, format)
+	}
+	return format, nil
+}
+
+// newExportWriter CSV は先頭に列名のヘッダー行を付ける
+func newExportWriter(c echo.Context, format string, columns []CSVColumn) (exportWriter, error) {
+	res := c.Response()
+	if format == ExportFormatNDJSON {
+		res.Header().Set(echo.HeaderContentType, MIMEApplicationNDJSON)
+		res.WriteHeader(http.StatusOK)
+		return &ndjsonExportWriter{w: bufio.NewWriter(res), columns: columns}, nil
+	}
+
+	res.Header().Set(echo.HeaderContentType, "text/csv; charset=UTF-8")
+	res.WriteHeader(http.StatusOK)
+	w := &csvExportWriter{w: csv.NewWriter(res)}
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = column.Name
+	}
+	return w, w.Write(header)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func estateRecord(e *Estate) []string {
+	return []string{
+		strconv.FormatInt(e.ID, 10),
+		e.Name,
+		e.Description,
+		e.Thumbnail,
+		e.Address,
+		formatFloat(e.Latitude),
+		formatFloat(e.Longitude),
+		strconv.FormatInt(e.Rent, 10),
+		strconv.FormatInt(e.DoorHeight, 10),
+		strconv.FormatInt(e.DoorWidth, 10),
+		e.Features,
+		strconv.FormatInt(e.Popularity, 10),
+	}
+}
+
+func chairRecord(chair *Chair) []string {
+	return []string{
+		strconv.FormatInt(chair.ID, 10),
+		chair.Name,
+		chair.Description,
+		chair.Thumbnail,
+		strconv.FormatInt(chair.Price, 10),
+		strconv.FormatInt(chair.Height, 10),
+		strconv.FormatInt(chair.Width, 10),
+		strconv.FormatInt(chair.Depth, 10),
+		chair.Color,
+		chair.Features,
+		chair.Kind,
+		strconv.FormatInt(chair.Popularity, 10),
+		strconv.FormatInt(chair.Stock, 10),
+	}
+}
+
+// exportEstates 検索と同じ条件で絞り込んだ物件を id 順に書き出す、条件が無ければ全件
+func exportEstates(c echo.Context) error {
+	filter, err := parseEstateSearchFilter(c)
+	if err != nil {
+		c.Logger().Infof("exportEstates : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	format, err := parseExportFormat(c)
+	if err != nil {
+		c.Logger().Infof("exportEstates : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	condition, params := filter.sql()
+	query := "SELECT id, thumbnail, name, description, latitude, longitude, address, rent, door_height, door_width, features, popularity FROM estate WHERE " + condition + " ORDER BY id"
+	rows, err := db.Queryx(query, params...)
+	if err != nil {
+		c.Logger().Errorf("exportEstates DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer rows.Close()
+
+	w, err := newExportWriter(c, format, estateCSVColumns)
+	if err != nil {
+		c.Logger().Errorf("exportEstates write error : %v", err)
+		return nil
+	}
+	for rows.Next() {
+		var e Estate
+		if err := rows.StructScan(&e); err != nil {
+			c.Logger().Errorf("exportEstates DB execution error : %v", err)
+			return nil
+		}
+		if err := w.Write(estateRecord(&e)); err != nil {
+			c.Logger().Errorf("exportEstates write error : %v", err)
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		c.Logger().Errorf("exportEstates DB execution error : %v", err)
+		return nil
+	}
+	if err := w.Flush(); err != nil {
+		c.Logger().Errorf("exportEstates write error : %v", err)
+	}
+	return nil
+}
+
+// exportChairs 検索と同じ条件で絞り込んだ椅子を id 順に書き出す、条件が無ければ全件
+// 検索と違って在庫切れの椅子も書き出す
+func exportChairs(c echo.Context) error {
+	filter, err := parseChairSearchFilter(c)
+	if err != nil {
+		c.Logger().Infof("exportChairs : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	format, err := parseExportFormat(c)
+	if err != nil {
+		c.Logger().Infof("exportChairs : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	condition, params := filter.exportSQL()
+	query := "SELECT id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock FROM chair WHERE " + condition + " ORDER BY id"
+	rows, err := db.Queryx(query, params...)
+	if err != nil {
+		c.Logger().Errorf("exportChairs DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer rows.Close()
+
+	w, err := newExportWriter(c, format, chairCSVColumns)
+	if err != nil {
+		c.Logger().Errorf("exportChairs write error : %v", err)
+		return nil
+	}
+	for rows.Next() {
+		var chair Chair
+		if err := rows.StructScan(&chair); err != nil {
+			c.Logger().Errorf("exportChairs DB execution error : %v", err)
+			return nil
+		}
+		if err := w.Write(chairRecord(&chair)); err != nil {
+			c.Logger().Errorf("exportChairs write error : %v", err)
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		c.Logger().Errorf("exportChairs DB execution error : %v", err)
+		return nil
+	}
+	if err := w.Flush(); err != nil {
+		c.Logger().Errorf("exportChairs write error : %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// FitOptions 椅子がドアを通るかの判定条件
+type FitOptions struct {
+	// Clearance 椅子の各辺に足す余裕 (cm)
+	Clearance int64
+	// Diagonal 椅子を斜めに傾けて通すことを許す
+	Diagonal bool
+}
+
+// Fit 椅子のどの辺をドアの幅、高さに合わせると通るか
+type Fit struct {
+	// Orientation straight, rotated, diagonal のいずれか
+	Orientation string `json:"orientation"`
+	// Across ドアの幅方向に向ける椅子の辺
+	Across string `json:"across"`
+	// Along ドアの高さ方向に向ける椅子の辺
+	Along string `json:"along"`
+}
+
+type chairSide struct {
+	Name   string
+	Length int64
+}
+
+// chairCrossSection 椅子の辺を短い順に並べた最短辺と2番目の辺、最長辺は通す方向になる
+func chairCrossSection(chair Chair) (chairSide, chairSide) {
+	sides := []chairSide{
+		{Name: "width", Length: chair.Width},
+		{Name: "height", Length: chair.Height},
+		{Name: "depth", Length: chair.Depth},
+	}
+	sort.SliceStable(sides, func(i, j int) bool { return sides[i].Length < sides[j].Length })
+	return sides[0], sides[1]
+}
+
+// fitsDiagonally p x q (p >= q) の長方形が a x b (a >= b) の長方形に傾けて入るか (Carver の条件)
+func fitsDiagonally(p, q, a, b float64) bool {
+	if p <= a && q <= b {
+		return true
+	}
+	if q > b {
+		return false
+	}
+	return b >= (2*p*q*a+(p*p-q*q)*math.Sqrt(p*p+q*q-a*a))/(p*p+q*q)
+}
+
+// fitThroughDoor 椅子が doorWidth x doorHeight のドアを通るかと、その向き
+func fitThroughDoor(chair Chair, doorWidth, doorHeight int64, opt FitOptions) (Fit, bool) {
+	short, mid := chairCrossSection(chair)
+	s, m := short.Length+opt.Clearance, mid.Length+opt.Clearance
+
+	if s <= doorWidth && m <= doorHeight {
+		return Fit{Orientation: "straight", Across: short.Name, Along: mid.Name}, true
+	}
+	if m <= doorWidth && s <= doorHeight {
+		return Fit{Orientation: "rotated", Across: mid.Name, Along: short.Name}, true
+	}
+	if !opt.Diagonal {
+		return Fit{}, false
+	}
+
+	a, b := float64(doorHeight), float64(doorWidth)
+	if a < b {
+		a, b = b, a
+	}
+	if !fitsDiagonally(float64(m), float64(s), a, b) {
+		return Fit{}, false
+	}
+	if doorHeight >= doorWidth {
+		return Fit{Orientation: "diagonal", Across: short.Name, Along: mid.Name}, true
+	}
+	return Fit{Orientation: "diagonal", Across: mid.Name, Along: short.Name}, true
+}
+
+func parseFitOptions(c echo.Context) (FitOptions, error) {
+	var opt FitOptions
+	if c.QueryParam("clearance") != "" {
+		clearance, err := strconv.ParseInt(c.QueryParam("clearance"), 10, 64)
+		if err != nil || clearance < 0 {
+			return opt, fmt.Errorf("clearance invalid : %v", c.QueryParam("clearance"))
+		}
+		opt.Clearance = clearance
+	}
+	if c.QueryParam("diagonal") != "" {
+		diagonal, err := strconv.ParseBool(c.QueryParam("diagonal"))
+		if err != nil {
+			return opt, fmt.Errorf("diagonal invalid : %v", c.QueryParam("diagonal"))
+		}
+		opt.Diagonal = diagonal
+	}
+	return opt, nil
+}
+
+// RecommendedEstate 椅子が通る物件と通し方
+type RecommendedEstate struct {
+	Estate
+	Fits Fit `json:"fits"`
+}
+
+type RecommendedEstateResponse struct {
+	Estates []RecommendedEstate `json:"estates"`
+}
+
+// RecommendedFor 椅子が通る物件を popularity DESC, id ASC で limit 件まで返す
+func (idx *EstateIndex) RecommendedFor(chair Chair, opt FitOptions, limit int) []RecommendedEstate {
+	estates := []RecommendedEstate{}
+	for i := range idx.estates {
+		e := &idx.estates[i]
+		fit, ok := fitThroughDoor(chair, e.DoorWidth, e.DoorHeight, opt)
+		if !ok {
+			continue
+		}
+		estates = append(estates, RecommendedEstate{Estate: e.Estate(), Fits: fit})
+		if len(estates) >= limit {
+			break
+		}
+	}
+	return estates
+}
+
+func recommendedEstatesSQL(chair Chair, opt FitOptions, limit int) ([]RecommendedEstate, error) {
+	// 最短辺がドアの幅と高さの両方に収まることはどの通し方でも必要になる
+	short, _ := chairCrossSection(chair)
+	minDoor := short.Length + opt.Clearance
+	query := `SELECT id, thumbnail, name, description, latitude, longitude, address, rent, door_height, door_width, features, popularity FROM estate WHERE door_width >= ? AND door_height >= ? ORDER BY popularity DESC, id ASC`
+	rows, err := db.Queryx(query, minDoor, minDoor)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	estates := []RecommendedEstate{}
+	for rows.Next() && len(estates) < limit {
+		var e Estate
+		if err := rows.StructScan(&e); err != nil {
+			return nil, err
+		}
+		if fit, ok := fitThroughDoor(chair, e.DoorWidth, e.DoorHeight, opt); ok {
+			estates = append(estates, RecommendedEstate{Estate: e, Fits: fit})
+		}
+	}
+	return estates, rows.Err()
+}
+
+// RecommendedChair 物件のドアを通る椅子と通し方
+type RecommendedChair struct {
+	Chair
+	Fits Fit `json:"fits"`
+}
+
+type RecommendedChairResponse struct {
+	Chairs []RecommendedChair `json:"chairs"`
+}
+
+func recommendedChairsSQL(estate Estate, f ChairSearchFilter, opt FitOptions, limit int) ([]RecommendedChair, error) {
+	searchCondition, params := f.sql()
+	query := "SELECT id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock FROM chair WHERE " + searchCondition + " ORDER BY popularity DESC, id ASC"
+	rows, err := db.Queryx(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chairs := []RecommendedChair{}
+	for rows.Next() && len(chairs) < limit {
+		var chair Chair
+		if err := rows.StructScan(&chair); err != nil {
+			return nil, err
+		}
+		if fit, ok := fitThroughDoor(chair, estate.DoorWidth, estate.DoorHeight, opt); ok {
+			chairs = append(chairs, RecommendedChair{Chair: chair, Fits: fit})
+		}
+	}
+	return chairs, rows.Err()
+}
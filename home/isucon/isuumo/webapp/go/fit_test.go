@@ -0,0 +1,101 @@
+package main
+
+import "testing"
+
+func TestFitThroughDoor(t *testing.T) {
+	tests := []struct {
+		name                  string
+		chair                 Chair
+		doorWidth, doorHeight int64
+		opt                   FitOptions
+		want                  Fit
+		ok                    bool
+	}{
+		{
+			name:      "short side is not the first one",
+			chair:     Chair{Width: 1, Height: 3, Depth: 2},
+			doorWidth: 1, doorHeight: 2,
+			want: Fit{Orientation: "straight", Across: "width", Along: "depth"}, ok: true,
+		},
+		{
+			name:      "shortest side is height",
+			chair:     Chair{Width: 3, Height: 1, Depth: 2},
+			doorWidth: 1, doorHeight: 2,
+			want: Fit{Orientation: "straight", Across: "height", Along: "depth"}, ok: true,
+		},
+		{
+			name:      "rotated",
+			chair:     Chair{Width: 1, Height: 3, Depth: 2},
+			doorWidth: 2, doorHeight: 1,
+			want: Fit{Orientation: "rotated", Across: "depth", Along: "width"}, ok: true,
+		},
+		{
+			name:      "too large",
+			chair:     Chair{Width: 1, Height: 3, Depth: 2},
+			doorWidth: 1, doorHeight: 1,
+		},
+		{
+			name:      "clearance fits",
+			chair:     Chair{Width: 10, Height: 20, Depth: 30},
+			doorWidth: 12, doorHeight: 22,
+			opt:  FitOptions{Clearance: 2},
+			want: Fit{Orientation: "straight", Across: "width", Along: "height"}, ok: true,
+		},
+		{
+			name:      "clearance does not fit",
+			chair:     Chair{Width: 10, Height: 20, Depth: 30},
+			doorWidth: 12, doorHeight: 22,
+			opt: FitOptions{Clearance: 3},
+		},
+		{
+			name:      "10x1 through 9x9 needs diagonal",
+			chair:     Chair{Width: 10, Height: 1, Depth: 11},
+			doorWidth: 9, doorHeight: 9,
+		},
+		{
+			name:      "10x1 through 9x9 diagonally",
+			chair:     Chair{Width: 10, Height: 1, Depth: 11},
+			doorWidth: 9, doorHeight: 9,
+			opt:  FitOptions{Diagonal: true},
+			want: Fit{Orientation: "diagonal", Across: "height", Along: "width"}, ok: true,
+		},
+		{
+			name:      "10x1 through 7x7 even diagonally",
+			chair:     Chair{Width: 10, Height: 1, Depth: 11},
+			doorWidth: 7, doorHeight: 7,
+			opt: FitOptions{Diagonal: true},
+		},
+		{
+			name:      "diagonal through a wide door",
+			chair:     Chair{Width: 10, Height: 1, Depth: 11},
+			doorWidth: 9, doorHeight: 8,
+			opt:  FitOptions{Diagonal: true},
+			want: Fit{Orientation: "diagonal", Across: "width", Along: "height"}, ok: true,
+		},
+	}
+	for _, tt := range tests {
+		got, ok := fitThroughDoor(tt.chair, tt.doorWidth, tt.doorHeight, tt.opt)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("%v : fitThroughDoor() = %+v, %v, want %+v, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFitsDiagonally(t *testing.T) {
+	tests := []struct {
+		p, q, a, b float64
+		want       bool
+	}{
+		{p: 5, q: 3, a: 6, b: 4, want: true},
+		{p: 10, q: 1, a: 9, b: 9, want: true},
+		{p: 10, q: 1, a: 7, b: 7, want: false},
+		{p: 10, q: 5, a: 12, b: 4, want: false},
+		{p: 100, q: 1, a: 99, b: 20, want: true},
+		{p: 100, q: 1, a: 99, b: 10, want: false},
+	}
+	for _, tt := range tests {
+		if got := fitsDiagonally(tt.p, tt.q, tt.a, tt.b); got != tt.want {
+			t.Errorf("fitsDiagonally(%v, %v, %v, %v) = %v, want %v", tt.p, tt.q, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
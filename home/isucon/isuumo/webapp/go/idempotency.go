@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+const (
+	HeaderIdempotencyKey      = "Idempotency-Key"
+	HeaderIdempotentReplayed  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	idempotencyStatusInFlight = 0
+
+	// idempotencyKeyTTL 保存した結果を返す期間、過ぎたら同じキーで新しいリクエストとして処理する
+	idempotencyKeyTTL = 24 * time.Hour
+	// idempotencyInFlightTTL 処理中のまま残ったキーを諦めるまでの時間、プロセスが落ちたときに 409 を返し続けないようにする
+	// 更新系のハンドラーは結果を saveIdempotentJSON で更新と同じトランザクションに保存するので、
+	// 処理中のまま残ったキーの更新はコミットされておらず、取り直してもやり直しにはならない
+	idempotencyInFlightTTL         = 10 * time.Minute
+	idempotencySweepInterval       = time.Minute
+	maxSweptIdempotencyKeysPerTurn = 1000
+)
+
+// idempotencyClaimContextKey 取ったキーを echo.Context に入れておくためのキー
+const idempotencyClaimContextKey = "idempotencyClaim"
+
+// errIdempotencyKeyLost 処理中に期限が切れて、キーを別のリクエストに取り直された
+var errIdempotencyKeyLost = errors.New("idempotency key was reclaimed by another request")
+
+// idempotencyClaim このリクエストが取ったキー、created_at で取り直された後の行と区別する
+type idempotencyClaim struct {
+	key       string
+	createdAt time.Time
+}
+
+type idempotencyRecord struct {
+	RequestHash string `db:"request_hash"`
+	Status      int    `db:"status"`
+	ContentType string `db:"content_type"`
+	Body        []byte `db:"body"`
+}
+
+// responseRecorder 書き出したレスポンスボディを控えておく
+type responseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func idempotencyRequestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotent Idempotency-Key ヘッダーがあれば最初の結果を保存し、同じキーと同じリクエストの再送にはそれを返す
+// 同じキーで違うリクエストが来たら 422、最初のリクエストがまだ処理中なら 409 を返す
+// 5xx やエラーになった結果は保存せず、再送で処理をやり直せるようにする
+// 期限切れのキーは使われたときと sweepIdempotencyKeys で消す
+func idempotent(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get(HeaderIdempotencyKey)
+		if key == "" {
+			return next(c)
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			c.Logger().Infof("idempotency key is too long : %v", len(key))
+			return c.NoContent(http.StatusBadRequest)
+		}
+
+		body, err := ioutil.ReadAll(c.Request().Body)
+		if err != nil {
+			c.Logger().Infof("failed to read request body : %v", err)
+			return c.NoContent(http.StatusBadRequest)
+		}
+		c.Request().Body = ioutil.NopCloser(bytes.NewReader(body))
+		hash := idempotencyRequestHash(c.Request(), body)
+
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		inFlightDeadline, deadline := idempotencyDeadlines(now)
+		_, err = db.Exec("DELETE FROM idempotency_key WHERE idempotency_key = ? AND (created_at < ? OR (status = ? AND created_at < ?))",
+			key, deadline, idempotencyStatusInFlight, inFlightDeadline)
+		if err != nil {
+			c.Logger().Errorf("idempotency key delete failed : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		res, err := db.Exec("INSERT IGNORE INTO idempotency_key(idempotency_key, request_hash, status, content_type, body, created_at) VALUES (?, ?, ?, '', '', ?)", key, hash, idempotencyStatusInFlight, now)
+		if err != nil {
+			c.Logger().Errorf("idempotency key insert failed : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		claimed, err := res.RowsAffected()
+		if err != nil {
+			c.Logger().Errorf("idempotency key insert failed : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if claimed == 0 {
+			return replayIdempotent(c, key, hash)
+		}
+
+		c.Set(idempotencyClaimContextKey, &idempotencyClaim{key: key, createdAt: now})
+		rec := &responseRecorder{ResponseWriter: c.Response().Writer}
+		c.Response().Writer = rec
+		err = next(c)
+		c.Response().Writer = rec.ResponseWriter
+
+		// ハンドラーがトランザクションの中で結果を保存していたら、status が処理中でなくなっているので触らない
+		// 期限切れで別のリクエストがキーを取り直していたら、そちらの行にも触らない
+		status := c.Response().Status
+		if err != nil || status >= http.StatusInternalServerError {
+			_, derr := db.Exec("DELETE FROM idempotency_key WHERE idempotency_key = ? AND created_at = ? AND status = ?", key, now, idempotencyStatusInFlight)
+			if derr != nil {
+				c.Logger().Errorf("idempotency key delete failed : %v", derr)
+			}
+			return err
+		}
+		_, uerr := db.Exec("UPDATE idempotency_key SET status = ?, content_type = ?, body = ? WHERE idempotency_key = ? AND created_at = ? AND status = ?",
+			status, c.Response().Header().Get(echo.HeaderContentType), rec.body.Bytes(), key, now, idempotencyStatusInFlight)
+		if uerr != nil {
+			c.Logger().Errorf("idempotency key update failed : %v", uerr)
+		}
+		return nil
+	}
+}
+
+// saveIdempotentJSON i を JSON にし、Idempotency-Key があれば tx の中でそのキーの結果として保存する
+// 更新と結果が一緒にコミットされるので、コミットの後でプロセスが落ちても再送で同じ処理をやり直さない
+// 返した body をコミットの後で c.JSONBlob に渡す
+func saveIdempotentJSON(c echo.Context, tx *sqlx.Tx, status int, i interface{}) ([]byte, error) {
+	body, err := json.Marshal(i)
+	if err != nil {
+		return nil, err
+	}
+	claim, ok := c.Get(idempotencyClaimContextKey).(*idempotencyClaim)
+	if !ok {
+		return body, nil
+	}
+	res, err := tx.Exec("UPDATE idempotency_key SET status = ?, content_type = ?, body = ? WHERE idempotency_key = ? AND created_at = ? AND status = ?",
+		status, echo.MIMEApplicationJSONCharsetUTF8, body, claim.key, claim.createdAt, idempotencyStatusInFlight)
+	if err != nil {
+		return nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, errIdempotencyKeyLost
+	}
+	return body, nil
+}
+
+func replayIdempotent(c echo.Context, key string, hash string) error {
+	var record idempotencyRecord
+	err := db.Get(&record, "SELECT request_hash, status, content_type, body FROM idempotency_key WHERE idempotency_key = ?", key)
+	if err == sql.ErrNoRows {
+		// 最初のリクエストが失敗して消えた直後
+		c.Logger().Infof("idempotency key %q was released, retry", key)
+		return c.NoContent(http.StatusConflict)
+	}
+	if err != nil {
+		c.Logger().Errorf("idempotency key select failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if record.RequestHash != hash {
+		c.Logger().Infof("idempotency key %q is reused for a different request", key)
+		return c.NoContent(http.StatusUnprocessableEntity)
+	}
+	if record.Status == idempotencyStatusInFlight {
+		c.Logger().Infof("idempotency key %q is in flight", key)
+		return c.NoContent(http.StatusConflict)
+	}
+
+	c.Response().Header().Set(HeaderIdempotentReplayed, "true")
+	if len(record.Body) == 0 {
+		return c.NoContent(record.Status)
+	}
+	return c.Blob(record.Status, record.ContentType, record.Body)
+}
+
+// idempotencyDeadlines これより前に作られた処理中のキーと、保存済みのキーは期限切れ
+func idempotencyDeadlines(now time.Time) (inFlight time.Time, completed time.Time) {
+	return now.Add(-idempotencyInFlightTTL), now.Add(-idempotencyKeyTTL)
+}
+
+// deleteExpiredIdempotencyKeys 期限切れのキーを消し、消した数を返す
+func deleteExpiredIdempotencyKeys(now time.Time) (int64, error) {
+	inFlightDeadline, deadline := idempotencyDeadlines(now)
+	res, err := db.Exec("DELETE FROM idempotency_key WHERE created_at < ? OR (status = ? AND created_at < ?) LIMIT ?",
+		deadline, idempotencyStatusInFlight, inFlightDeadline, maxSweptIdempotencyKeysPerTurn)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// sweepIdempotencyKeys idempotencySweepInterval ごとに期限切れのキーを消して、テーブルが増え続けないようにする
+func sweepIdempotencyKeys(logger echo.Logger) {
+	ticker := time.NewTicker(idempotencySweepInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		n, err := deleteExpiredIdempotencyKeys(now.UTC())
+		if err != nil {
+			logger.Errorf("sweepIdempotencyKeys : %v", err)
+			continue
+		}
+		if n > 0 {
+			logger.Infof("sweepIdempotencyKeys deleted %v keys", n)
+		}
+	}
+}
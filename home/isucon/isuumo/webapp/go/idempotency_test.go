@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+func serveIdempotent(e *echo.Echo, key string, body string, handler echo.HandlerFunc) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/test", strings.NewReader(body))
+	req.Header.Set(HeaderIdempotencyKey, key)
+	rec := httptest.NewRecorder()
+	if err := idempotent(handler)(e.NewContext(req, rec)); err != nil {
+		e.HTTPErrorHandler(err, e.NewContext(req, rec))
+	}
+	return rec
+}
+
+func TestIdempotencyKeyExpiry(t *testing.T) {
+	openTestDB(t)
+	e := echo.New()
+	calls := 0
+	handler := func(c echo.Context) error {
+		calls++
+		return c.String(http.StatusCreated, "created")
+	}
+	insertKey := func(key string, status int, createdAt time.Time) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/api/test", strings.NewReader("body"))
+		_, err := db.Exec("INSERT INTO idempotency_key(idempotency_key, request_hash, status, content_type, body, created_at) VALUES (?, ?, ?, '', '', ?)",
+			key, idempotencyRequestHash(req, []byte("body")), status, createdAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now().UTC()
+
+	insertKey("in-flight", idempotencyStatusInFlight, now)
+	if rec := serveIdempotent(e, "in-flight", "body", handler); rec.Code != http.StatusConflict {
+		t.Errorf("in-flight key: status = %v, want %v", rec.Code, http.StatusConflict)
+	}
+
+	insertKey("stale", idempotencyStatusInFlight, now.Add(-idempotencyInFlightTTL-time.Second))
+	if rec := serveIdempotent(e, "stale", "body", handler); rec.Code != http.StatusCreated || calls != 1 {
+		t.Errorf("stale in-flight key: status = %v, calls = %v, want %v and 1", rec.Code, calls, http.StatusCreated)
+	}
+	if rec := serveIdempotent(e, "stale", "body", handler); rec.Code != http.StatusCreated || calls != 1 || rec.Header().Get(HeaderIdempotentReplayed) != "true" {
+		t.Errorf("reclaimed key was not replayed: status = %v, calls = %v", rec.Code, calls)
+	}
+
+	insertKey("expired", http.StatusCreated, now.Add(-idempotencyKeyTTL-time.Second))
+	if rec := serveIdempotent(e, "expired", "other body", handler); rec.Code != http.StatusCreated || calls != 2 {
+		t.Errorf("expired key: status = %v, calls = %v, want %v and 2", rec.Code, calls, http.StatusCreated)
+	}
+
+	insertKey("old", http.StatusCreated, now.Add(-idempotencyKeyTTL-time.Second))
+	insertKey("old-in-flight", idempotencyStatusInFlight, now.Add(-idempotencyInFlightTTL-time.Second))
+	n, err := deleteExpiredIdempotencyKeys(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("deleteExpiredIdempotencyKeys() = %v, want 2", n)
+	}
+	var left int
+	if err := db.Get(&left, "SELECT COUNT(*) FROM idempotency_key"); err != nil {
+		t.Fatal(err)
+	}
+	if left != 3 {
+		t.Errorf("%v keys left, want 3", left)
+	}
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	openTestDB(t)
+	e := echo.New()
+	calls := 0
+	handler := func(c echo.Context) error {
+		calls++
+		return c.JSON(http.StatusOK, echo.Map{"call": calls})
+	}
+
+	first := serveIdempotent(e, "replay", "body", handler)
+	if first.Code != http.StatusOK {
+		t.Fatalf("first request: status = %v", first.Code)
+	}
+	again := serveIdempotent(e, "replay", "body", handler)
+	if again.Code != http.StatusOK || again.Body.String() != first.Body.String() || calls != 1 {
+		t.Errorf("replay = %v %q after %v calls, want %v %q after 1 call", again.Code, again.Body.String(), calls, first.Code, first.Body.String())
+	}
+	if again.Header().Get(HeaderIdempotentReplayed) != "true" {
+		t.Errorf("replay has no %v header", HeaderIdempotentReplayed)
+	}
+	if got := again.Header().Get(echo.HeaderContentType); got != first.Header().Get(echo.HeaderContentType) {
+		t.Errorf("replay content type = %q, want %q", got, first.Header().Get(echo.HeaderContentType))
+	}
+
+	if rec := serveIdempotent(e, "replay", "other body", handler); rec.Code != http.StatusUnprocessableEntity || calls != 1 {
+		t.Errorf("different body: status = %v after %v calls, want %v", rec.Code, calls, http.StatusUnprocessableEntity)
+	}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan int)
+	go func() {
+		rec := serveIdempotent(e, "slow", "body", func(c echo.Context) error {
+			close(started)
+			<-release
+			return c.NoContent(http.StatusOK)
+		})
+		done <- rec.Code
+	}()
+	<-started
+	if rec := serveIdempotent(e, "slow", "body", handler); rec.Code != http.StatusConflict || calls != 1 {
+		t.Errorf("in-flight key: status = %v after %v calls, want %v", rec.Code, calls, http.StatusConflict)
+	}
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("slow request: status = %v", code)
+	}
+}
+
+// TestSaveIdempotentJSON トランザクションの中で保存した結果は、その後で 5xx になっても消えずに再送で返る
+func TestSaveIdempotentJSON(t *testing.T) {
+	openTestDB(t)
+	e := echo.New()
+	calls := 0
+	handler := func(c echo.Context) error {
+		calls++
+		tx, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := saveIdempotentJSON(c, tx, http.StatusOK, echo.Map{"call": calls}); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		// コミットの後でレスポンスを返せなかった
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if rec := serveIdempotent(e, "committed", "body", handler); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("first request: status = %v", rec.Code)
+	}
+	rec := serveIdempotent(e, "committed", "body", handler)
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"call":1}` || calls != 1 {
+		t.Errorf("retry = %v %q after %v calls, want the committed response", rec.Code, rec.Body.String(), calls)
+	}
+
+	// 処理中に期限切れで取り直されたキーには保存しない
+	lost := func(c echo.Context) error {
+		if _, err := db.Exec("UPDATE idempotency_key SET created_at = ? WHERE idempotency_key = ?", time.Now().UTC().Add(time.Second), "lost"); err != nil {
+			return err
+		}
+		tx, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := saveIdempotentJSON(c, tx, http.StatusOK, echo.Map{}); err != errIdempotencyKeyLost {
+			t.Errorf("saveIdempotentJSON() error = %v, want %v", err, errIdempotencyKeyLost)
+		}
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	serveIdempotent(e, "lost", "body", lost)
+}
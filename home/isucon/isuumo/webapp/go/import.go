@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo"
+)
+
+// importBatchSize 1回の INSERT でまとめて入れる行数
+const importBatchSize = 500
+
+// MIMEApplicationNDJSON 1行に1つの JSON を並べた形式
+const MIMEApplicationNDJSON = "application/x-ndjson"
+
+const (
+	ImportModeStrict  = "strict"
+	ImportModeLenient = "lenient"
+)
+
+// RejectedLine 取り込めなかった行と理由
+type RejectedLine struct {
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+// ImportReport CSV 取り込み結果
+// strict では1行でも不正な行があれば何も登録せず、lenient では不正な行だけを飛ばして登録する
+// ヘッダー行に必須の列が無ければ mode にかかわらず何も登録しない
+type ImportReport struct {
+	Mode           string         `json:"mode"`
+	Inserted       int            `json:"inserted"`
+	Rejected       []RejectedLine `json:"rejected"`
+	UnknownColumns []string       `json:"unknownColumns,omitempty"`
+	MissingColumns []string       `json:"missingColumns,omitempty"`
+}
+
+func (r ImportReport) Failed() bool {
+	return len(r.MissingColumns) > 0 || (r.Mode == ImportModeStrict && len(r.Rejected) > 0)
+}
+
+// CSVColumn 取り込む CSV の列、並びはヘッダー行が無い場合の列の順番になる
+type CSVColumn struct {
+	Name     string
+	Aliases  []string
+	Required bool
+	// Number JSON では文字列ではなく数値として書き出す
+	Number bool
+	// JSONKey JSON で書き出すときのキー、空なら Name と同じ
+	JSONKey string
+}
+
+func (c CSVColumn) jsonKey() string {
+	if c.JSONKey != "" {
+		return c.JSONKey
+	}
+	return c.Name
+}
+
+var estateCSVColumns = []CSVColumn{
+	{Name: "id", Required: true, Number: true},
+	{Name: "name", Aliases: []string{"title"}, Required: true},
+	{Name: "description"},
+	{Name: "thumbnail", Aliases: []string{"image"}},
+	{Name: "address", Required: true},
+	{Name: "latitude", Aliases: []string{"lat"}, Required: true, Number: true},
+	{Name: "longitude", Aliases: []string{"lng", "lon"}, Required: true, Number: true},
+	{Name: "rent", Required: true, Number: true},
+	{Name: "door_height", Required: true, Number: true, JSONKey: "doorHeight"},
+	{Name: "door_width", Required: true, Number: true, JSONKey: "doorWidth"},
+	{Name: "features", Aliases: []string{"feature"}},
+	{Name: "popularity", Required: true, Number: true},
+}
+
+var chairCSVColumns = []CSVColumn{
+	{Name: "id", Required: true, Number: true},
+	{Name: "name", Aliases: []string{"title"}, Required: true},
+	{Name: "description"},
+	{Name: "thumbnail", Aliases: []string{"image"}},
+	{Name: "price", Required: true, Number: true},
+	{Name: "height", Required: true, Number: true},
+	{Name: "width", Required: true, Number: true},
+	{Name: "depth", Required: true, Number: true},
+	{Name: "color", Aliases: []string{"colour"}, Required: true},
+	{Name: "features", Aliases: []string{"feature"}},
+	{Name: "kind", Aliases: []string{"category"}, Required: true},
+	{Name: "popularity", Required: true, Number: true},
+	{Name: "stock", Aliases: []string{"quantity"}, Required: true, Number: true},
+}
+
+// CSVHeader ヘッダー行から求めた、CSVColumn ごとの列の位置 (無ければ -1)
+type CSVHeader struct {
+	Columns   []CSVColumn
+	Positions []int
+	Unknown   []string
+	Missing   []string
+}
+
+// normalizeColumnName door_height, doorHeight, Door-Height などを同じ名前として扱う
+func normalizeColumnName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return strings.NewReplacer("_", "", "-", "", " ", "").Replace(name)
+}
+
+// parseCSVHeader record の列名を columns に対応づける、列名を1つも含まなければ false を返す
+func parseCSVHeader(columns []CSVColumn, record []string) (*CSVHeader, bool) {
+	names := map[string]int{}
+	for i, column := range columns {
+		names[normalizeColumnName(column.Name)] = i
+		for _, alias := range column.Aliases {
+			names[normalizeColumnName(alias)] = i
+		}
+	}
+
+	header := &CSVHeader{Columns: columns, Positions: make([]int, len(columns))}
+	for i := range header.Positions {
+		header.Positions[i] = -1
+	}
+	found := false
+	for pos, field := range record {
+		i, ok := names[normalizeColumnName(field)]
+		if !ok || header.Positions[i] >= 0 {
+			header.Unknown = append(header.Unknown, field)
+			continue
+		}
+		header.Positions[i] = pos
+		found = true
+	}
+	if !found {
+		return nil, false
+	}
+	for i, column := range columns {
+		if column.Required && header.Positions[i] < 0 {
+			header.Missing = append(header.Missing, column.Name)
+		}
+	}
+	return header, true
+}
+
+// isHeader 必須の列の過半数が揃っていればヘッダー行とみなす
+// 1列だけで判定すると、name や kind と同じ値を持つデータ行をヘッダー行と取り違える
+func (h *CSVHeader) isHeader() bool {
+	required, found := 0, 0
+	for i, column := range h.Columns {
+		if !column.Required {
+			continue
+		}
+		required++
+		if h.Positions[i] >= 0 {
+			found++
+		}
+	}
+	return found*2 > required
+}
+
+func parseImportMode(c echo.Context) (string, error) {
+	switch mode := c.QueryParam("mode"); mode {
+	case "", ImportModeStrict:
+		return ImportModeStrict, nil
+	case ImportModeLenient:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown import mode : %v", mode)
+	}
+}
+
+// importBatch 取り込み中の行をためておき、まとめて INSERT する
+type importBatch interface {
+	// Add 1行を読んでためる、不正な行ならエラーを返す
+	Add(rm *RecordMapper) error
+	// AddJSON JSON のオブジェクトを1つ読んでためる、知らないキーは unknown に加える
+	AddJSON(raw []byte, unknown map[string]bool) error
+	Len() int
+	// Flush ためた行をまとめて INSERT する、失敗したら1行も入れずにためた行を残す
+	Flush() error
+	// FlushRow ためた i 番目の行だけを INSERT する
+	FlushRow(i int) error
+	// Reset ためた行を捨てる
+	Reset()
+}
+
+// errInvalidImportBody 取り込むデータそのものが読めない
+var errInvalidImportBody = errors.New("invalid import body")
+
+// importer 行ごとの不正を report に積みながら、importBatchSize 行たまるごとに INSERT する
+type importer struct {
+	report ImportReport
+	batch  importBatch
+	// lines batch にためた行の番号
+	lines []int
+}
+
+func newImporter(mode string, batch importBatch) *importer {
+	return &importer{report: ImportReport{Mode: mode, Rejected: []RejectedLine{}}, batch: batch}
+}
+
+func (im *importer) reject(line int, reason string) {
+	im.report.Rejected = append(im.report.Rejected, RejectedLine{Line: line, Reason: reason})
+}
+
+func (im *importer) reset() {
+	im.batch.Reset()
+	im.lines = im.lines[:0]
+}
+
+func (im *importer) add(line int, rm *RecordMapper) error {
+	return im.added(line, im.batch.Add(rm))
+}
+
+func (im *importer) addJSON(line int, raw []byte, unknown map[string]bool) error {
+	return im.added(line, im.batch.AddJSON(raw, unknown))
+}
+
+// added batch に1行ためた結果を report に反映し、importBatchSize 行たまっていれば INSERT する
+func (im *importer) added(line int, err error) error {
+	if err != nil {
+		im.reject(line, err.Error())
+		return nil
+	}
+	im.lines = append(im.lines, line)
+	if im.report.Failed() {
+		im.reset()
+		return nil
+	}
+	if im.batch.Len() >= importBatchSize {
+		return im.flush()
+	}
+	return nil
+}
+
+// flush DB に拒否された行があれば、どの行かを知るために1行ずつ入れ直して report に積む
+func (im *importer) flush() error {
+	n := im.batch.Len()
+	if n == 0 {
+		return nil
+	}
+	err := im.batch.Flush()
+	if err == nil {
+		im.report.Inserted += n
+		im.lines = im.lines[:0]
+		return nil
+	}
+	if !isRejectedRow(err) {
+		return err
+	}
+
+	for i, line := range im.lines {
+		if im.report.Failed() {
+			break
+		}
+		if err := im.batch.FlushRow(i); err != nil {
+			if !isRejectedRow(err) {
+				return err
+			}
+			im.reject(line, err.Error())
+			continue
+		}
+		im.report.Inserted++
+	}
+	im.reset()
+	return nil
+}
+
+func (im *importer) finish() (ImportReport, error) {
+	if !im.report.Failed() {
+		if err := im.flush(); err != nil {
+			return im.report, err
+		}
+	}
+	if im.report.Failed() {
+		im.reset()
+		im.report.Inserted = 0
+	}
+	return im.report, nil
+}
+
+// isRejectedRow 行の内容が原因で MySQL に拒否されたか
+// デッドロックやロック待ちのタイムアウトはトランザクションごと取り消されるので含めない
+func isRejectedRow(err error) bool {
+	me, ok := err.(*mysql.MySQLError)
+	return ok && me.Number != 1205 && me.Number != 1213
+}
+
+// withSavepoint fn が失敗したら fn の中で実行した文だけを取り消す
+func withSavepoint(tx *sql.Tx, fn func() error) error {
+	if _, err := tx.Exec("SAVEPOINT import_batch"); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		if _, rerr := tx.Exec("ROLLBACK TO SAVEPOINT import_batch"); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	_, err := tx.Exec("RELEASE SAVEPOINT import_batch")
+	return err
+}
+
+// csvLineReader レコードと、そのレコードが始まる物理行の番号を返す
+// 引用符の中の改行や空行があっても行番号がずれないように、行を読んでレコードの区切りを自分で見つけてから csv.Reader に渡す
+type csvLineReader struct {
+	r      *bufio.Reader
+	line   int
+	chunk  chunkReader
+	reader *csv.Reader
+}
+
+// chunkReader csvLineReader が区切った1レコード分だけを読ませる
+type chunkReader struct {
+	b []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+func newCSVLineReader(r io.Reader) *csvLineReader {
+	lr := &csvLineReader{r: bufio.NewReader(r)}
+	lr.resetReader()
+	return lr
+}
+
+func (lr *csvLineReader) resetReader() {
+	lr.chunk.b = nil
+	lr.reader = csv.NewReader(&lr.chunk)
+	lr.reader.FieldsPerRecord = -1
+}
+
+// csvQuoteOpen chunk が引用符で囲まれたフィールドの途中で終わっているか
+func csvQuoteOpen(chunk []byte) bool {
+	inQuotes, fieldStart := false, true
+	for i := 0; i < len(chunk); i++ {
+		c := chunk[i]
+		switch {
+		case inQuotes:
+			if c == '"' {
+				if i+1 < len(chunk) && chunk[i+1] == '"' {
+					i++
+				} else {
+					inQuotes = false
+				}
+			}
+		case c == '"' && fieldStart:
+			inQuotes = true
+		}
+		fieldStart = !inQuotes && (c == ',' || c == '\n')
+	}
+	return inQuotes
+}
+
+func (lr *csvLineReader) Read() ([]string, int, error) {
+	var chunk []byte
+	start := 0
+	for {
+		b, err := lr.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, start, err
+		}
+		if len(b) > 0 {
+			lr.line++
+			if len(chunk) == 0 {
+				// csv.Reader と同じく空行は読み飛ばす
+				if len(bytes.TrimRight(b, "\r\n")) == 0 {
+					b = nil
+				} else {
+					start = lr.line
+				}
+			}
+			chunk = append(chunk, b...)
+		}
+		if err == io.EOF || (len(chunk) > 0 && !csvQuoteOpen(chunk)) {
+			break
+		}
+	}
+	if len(chunk) == 0 {
+		return nil, 0, io.EOF
+	}
+
+	lr.chunk.b = chunk
+	record, err := lr.reader.Read()
+	if err != nil {
+		// 読み残しが次のレコードに混ざらないように読み直す
+		lr.resetReader()
+	}
+	return record, start, err
+}
+
+// importCSV CSV を1行ずつ読み、importBatchSize 行たまるごとに INSERT する
+// 行の不正は report に積み、INSERT のエラーはそのまま返す
+func importCSV(r io.Reader, mode string, columns []CSVColumn, batch importBatch) (ImportReport, error) {
+	im := newImporter(mode, batch)
+	reader := newCSVLineReader(r)
+	var header *CSVHeader
+	for first := true; ; first = false {
+		record, line, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if pe, ok := err.(*csv.ParseError); ok {
+				im.reject(line, pe.Err.Error())
+				continue
+			}
+			return im.report, err
+		}
+
+		if first {
+			if h, ok := parseCSVHeader(columns, record); ok && h.isHeader() {
+				header = h
+				im.report.UnknownColumns = h.Unknown
+				im.report.MissingColumns = h.Missing
+				if im.report.Failed() {
+					return im.report, nil
+				}
+				continue
+			}
+		}
+
+		if err := im.add(line, &RecordMapper{Record: record, Header: header}); err != nil {
+			return im.report, err
+		}
+	}
+	return im.finish()
+}
+
+// decodeJSONRecord JSON のオブジェクト raw を v に読む
+// required のキーが無いか null なら取り込まず、v に無いキーは unknown に加えて読み飛ばす
+func decodeJSONRecord(raw []byte, v interface{}, required []string, unknown map[string]bool) error {
+	object := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return err
+	}
+	known := jsonKeys(reflect.TypeOf(v).Elem())
+	for key := range object {
+		if !known[key] {
+			unknown[key] = true
+		}
+	}
+	for _, key := range required {
+		if value, ok := object[key]; !ok || string(value) == "null" {
+			return fmt.Errorf("%s: missing", key)
+		}
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// jsonKeys 構造体 t を encoding/json が読むキー、埋め込んだ構造体のキーも含める
+func jsonKeys(t reflect.Type) map[string]bool {
+	keys := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			for key := range jsonKeys(f.Type) {
+				keys[key] = true
+			}
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name != "-" && name != "" {
+			keys[name] = true
+		}
+	}
+	return keys
+}
+
+func (im *importer) unknownColumns(unknown map[string]bool) {
+	for key := range unknown {
+		im.report.UnknownColumns = append(im.report.UnknownColumns, key)
+	}
+	sort.Strings(im.report.UnknownColumns)
+}
+
+// importJSON JSON の配列を要素ごとに読む、line は1始まりの要素の番号
+func importJSON(r io.Reader, mode string, batch importBatch) (ImportReport, error) {
+	im := newImporter(mode, batch)
+	unknown := map[string]bool{}
+	dec := json.NewDecoder(r)
+	if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+		return im.report, fmt.Errorf("%w: expected a JSON array", errInvalidImportBody)
+	}
+	for line := 1; dec.More(); line++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return im.report, fmt.Errorf("%w: element %d: %v", errInvalidImportBody, line, err)
+		}
+		if err := im.addJSON(line, raw, unknown); err != nil {
+			return im.report, err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return im.report, fmt.Errorf("%w: %v", errInvalidImportBody, err)
+	}
+	im.unknownColumns(unknown)
+	return im.finish()
+}
+
+// importNDJSON 1行に1つの JSON オブジェクトを読む、空行は読み飛ばす
+func importNDJSON(r io.Reader, mode string, batch importBatch) (ImportReport, error) {
+	im := newImporter(mode, batch)
+	unknown := map[string]bool{}
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		b, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return im.report, err
+		}
+		if text := bytes.TrimSpace(b); len(text) > 0 {
+			if aerr := im.addJSON(line, text, unknown); aerr != nil {
+				return im.report, aerr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	im.unknownColumns(unknown)
+	return im.finish()
+}
+
+// importRequest Content-Type が JSON や NDJSON ならリクエストボディを、それ以外は multipart の field を CSV として取り込む
+func importRequest(c echo.Context, field string, mode string, columns []CSVColumn, batch importBatch) (ImportReport, error) {
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	switch mediaType {
+	case echo.MIMEApplicationJSON:
+		return importJSON(c.Request().Body, mode, batch)
+	case MIMEApplicationNDJSON:
+		return importNDJSON(c.Request().Body, mode, batch)
+	}
+
+	header, err := c.FormFile(field)
+	if err != nil {
+		return ImportReport{}, fmt.Errorf("%w: failed to get form file: %v", errInvalidImportBody, err)
+	}
+	f, err := header.Open()
+	if err != nil {
+		return ImportReport{}, fmt.Errorf("failed to open form file: %v", err)
+	}
+	defer f.Close()
+	return importCSV(f, mode, columns, batch)
+}
+
+func parseUpsert(c echo.Context) (bool, error) {
+	if c.QueryParam("upsert") == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(c.QueryParam("upsert"))
+}
+
+// bulkInsertSQL "INSERT INTO table(columns) VALUES (row),(row),..." を組み立てる
+// upsert なら先頭のカラムを主キーとして、既存の行を残りのカラムで上書きする
+func bulkInsertSQL(table string, columns []string, row string, rows int, upsert bool) string {
+	values := make([]string, rows)
+	for i := range values {
+		values[i] = row
+	}
+	query := fmt.Sprintf("INSERT INTO %s(%s) VALUES %s", table, strings.Join(columns, ", "), strings.Join(values, ","))
+	if !upsert {
+		return query
+	}
+	updates := make([]string, 0, len(columns)-1)
+	for _, column := range columns[1:] {
+		updates = append(updates, fmt.Sprintf("%s = VALUES(%s)", column, column))
+	}
+	return query + " ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+}
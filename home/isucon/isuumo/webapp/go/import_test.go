@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// testChairBatch DB の代わりに、duplicate に含まれる id を MySQL と同じエラーで拒否する
+type testChairBatch struct {
+	rows      []Chair
+	inserted  []Chair
+	duplicate map[int64]bool
+	fail      error
+}
+
+func (b *testChairBatch) Add(rm *RecordMapper) error {
+	chair, err := chairFromRecord(rm)
+	if err != nil {
+		return err
+	}
+	b.rows = append(b.rows, chair)
+	return nil
+}
+
+func (b *testChairBatch) AddJSON(raw []byte, unknown map[string]bool) error {
+	chair, err := chairFromJSON(raw, unknown)
+	if err != nil {
+		return err
+	}
+	b.rows = append(b.rows, chair)
+	return nil
+}
+
+func (b *testChairBatch) Len() int {
+	return len(b.rows)
+}
+
+func (b *testChairBatch) insert(rows []Chair) error {
+	if b.fail != nil {
+		return b.fail
+	}
+	for _, chair := range rows {
+		if b.duplicate[chair.ID] {
+			return &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}
+		}
+	}
+	b.inserted = append(b.inserted, rows...)
+	return nil
+}
+
+func (b *testChairBatch) Flush() error {
+	if err := b.insert(b.rows); err != nil {
+		return err
+	}
+	b.rows = b.rows[:0]
+	return nil
+}
+
+func (b *testChairBatch) FlushRow(i int) error {
+	return b.insert(b.rows[i : i+1])
+}
+
+func (b *testChairBatch) Reset() {
+	b.rows = b.rows[:0]
+}
+
+func (b *testChairBatch) insertedIDs() []int64 {
+	ids := []int64{}
+	for _, chair := range b.inserted {
+		ids = append(ids, chair.ID)
+	}
+	return ids
+}
+
+func testChairCSV(ids ...string) string {
+	lines := make([]string, 0, len(ids))
+	for _, id := range ids {
+		lines = append(lines, id+",椅子,desc,/images/chair.png,1000,60,50,40,黒,,座椅子,10,3")
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestImportCSVLineNumbers(t *testing.T) {
+	csv := testChairCSV("1") +
+		"2,椅子,\"multi\nline\ndesc\",/images/chair.png,1000,60,50,40,黒,,座椅子,10,3\n" +
+		"\n" +
+		testChairCSV("x") +
+		"4,\"broken\"quote,desc\n" +
+		"\r\n" +
+		testChairCSV("5", "y")
+	b := &testChairBatch{}
+	report, err := importCSV(strings.NewReader(csv), ImportModeLenient, chairCSVColumns, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := []int{}
+	for _, r := range report.Rejected {
+		lines = append(lines, r.Line)
+	}
+	if want := []int{6, 7, 10}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("rejected lines = %v, want %v (%+v)", lines, want, report.Rejected)
+	}
+	if want := []int64{1, 2, 5}; !reflect.DeepEqual(b.insertedIDs(), want) {
+		t.Errorf("inserted = %v, want %v", b.insertedIDs(), want)
+	}
+	if b.inserted[1].Description != "multi\nline\ndesc" {
+		t.Errorf("multi line description = %q", b.inserted[1].Description)
+	}
+}
+
+func TestImportCSVRejectedByDB(t *testing.T) {
+	csv := testChairCSV("1", "2", "3", "4")
+
+	b := &testChairBatch{duplicate: map[int64]bool{2: true, 4: true}}
+	report, err := importCSV(strings.NewReader(csv), ImportModeLenient, chairCSVColumns, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Inserted != 2 || len(report.Rejected) != 2 || report.Rejected[0].Line != 2 || report.Rejected[1].Line != 4 {
+		t.Errorf("lenient report = %+v", report)
+	}
+	if want := []int64{1, 3}; !reflect.DeepEqual(b.insertedIDs(), want) {
+		t.Errorf("inserted = %v, want %v", b.insertedIDs(), want)
+	}
+
+	b = &testChairBatch{duplicate: map[int64]bool{2: true}}
+	report, err = importCSV(strings.NewReader(csv), ImportModeStrict, chairCSVColumns, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Failed() || report.Inserted != 0 || len(report.Rejected) != 1 || report.Rejected[0].Line != 2 {
+		t.Errorf("strict report = %+v", report)
+	}
+
+	fail := errors.New("connection lost")
+	b = &testChairBatch{fail: fail}
+	if _, err := importCSV(strings.NewReader(csv), ImportModeLenient, chairCSVColumns, b); err != fail {
+		t.Errorf("importCSV() error = %v, want %v", err, fail)
+	}
+}
+
+func TestImportCSVHeaderDetection(t *testing.T) {
+	tests := []struct {
+		name     string
+		csv      string
+		inserted []int64
+		missing  []string
+	}{
+		{
+			name:     "data row with a column name as a value",
+			csv:      "1,name,desc,/images/chair.png,1000,60,50,40,color,,kind,10,3\n" + testChairCSV("2"),
+			inserted: []int64{1, 2},
+		},
+		{
+			name:     "reordered header",
+			csv:      "stock,popularity,kind,features,color,depth,width,height,price,thumbnail,description,name,id\n3,10,座椅子,,黒,40,50,60,1000,/images/chair.png,desc,椅子,1\n",
+			inserted: []int64{1},
+		},
+		{
+			name:    "header without stock",
+			csv:     "id,name,description,thumbnail,price,height,width,depth,color,features,kind,popularity\n" + testChairCSV("1"),
+			missing: []string{"stock"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &testChairBatch{}
+			report, err := importCSV(strings.NewReader(tt.csv), ImportModeStrict, chairCSVColumns, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Rejected) > 0 {
+				t.Errorf("rejected = %+v", report.Rejected)
+			}
+			if !reflect.DeepEqual(report.MissingColumns, tt.missing) {
+				t.Errorf("missing columns = %v, want %v", report.MissingColumns, tt.missing)
+			}
+			if len(tt.inserted) > 0 && !reflect.DeepEqual(b.insertedIDs(), tt.inserted) {
+				t.Errorf("inserted = %v, want %v", b.insertedIDs(), tt.inserted)
+			}
+		})
+	}
+}
+
+func TestImportJSONChairs(t *testing.T) {
+	body := `[
+		{"id": 1, "name": "椅子", "description": "desc", "thumbnail": "/images/chair.png", "price": 1000, "height": 60, "width": 50, "depth": 40, "color": "黒", "features": "", "kind": "座椅子"},
+		{"id": 2, "name": "椅子", "price": 1000, "height": 60, "width": 50, "depth": 40, "color": "黒", "kind": "座椅子", "popularity": 10, "stock": 0},
+		{"id": 3, "name": "椅子", "price": 1000, "height": 60, "width": 50, "depth": 40, "color": "黒", "kind": "座椅子", "quantity": 3},
+		{"id": 4, "name": "椅子", "height": 60, "width": 50, "depth": 40, "color": "黒", "kind": "座椅子"},
+		{"id": 5, "name": "椅子", "price": "1000", "height": 60, "width": 50, "depth": 40, "color": "黒", "kind": "座椅子"}
+	]`
+	b := &testChairBatch{}
+	report, err := importJSON(strings.NewReader(body), ImportModeLenient, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := []int{}
+	for _, r := range report.Rejected {
+		lines = append(lines, r.Line)
+	}
+	if want := []int{4, 5}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("rejected lines = %v, want %v (%+v)", lines, want, report.Rejected)
+	}
+	if want := []string{"quantity"}; !reflect.DeepEqual(report.UnknownColumns, want) {
+		t.Errorf("unknown columns = %v, want %v", report.UnknownColumns, want)
+	}
+	if want := []int64{1, 2, 3}; !reflect.DeepEqual(b.insertedIDs(), want) {
+		t.Fatalf("inserted = %v, want %v", b.insertedIDs(), want)
+	}
+	for i, want := range [][2]int64{{0, 1}, {10, 0}, {0, 1}} {
+		if got := b.inserted[i]; got.Popularity != want[0] || got.Stock != want[1] {
+			t.Errorf("chair %v : popularity %v stock %v, want %v %v", got.ID, got.Popularity, got.Stock, want[0], want[1])
+		}
+	}
+}
+
+// TestExportedNDJSONImports NDJSON で書き出した物件と椅子が、そのまま JSON として取り込める
+func TestExportedNDJSONImports(t *testing.T) {
+	var buf bytes.Buffer
+	e := testEstates(1)[0]
+	w := &ndjsonExportWriter{w: bufio.NewWriter(&buf), columns: estateCSVColumns}
+	estate := e.Estate()
+	if err := w.Write(estateRecord(&estate)); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	unknown := map[string]bool{}
+	got, err := estateFromJSON(buf.Bytes(), unknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unknown) > 0 || got != e {
+		t.Errorf("estateFromJSON() = %+v with unknown keys %v, want %+v", got, unknown, e)
+	}
+
+	buf.Reset()
+	chair := testChairs(1)[0]
+	w = &ndjsonExportWriter{w: bufio.NewWriter(&buf), columns: chairCSVColumns}
+	if err := w.Write(chairRecord(&chair)); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	gotChair, err := chairFromJSON(buf.Bytes(), unknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unknown) > 0 || gotChair != chair {
+		t.Errorf("chairFromJSON() = %+v with unknown keys %v, want %+v", gotChair, unknown, chair)
+	}
+}
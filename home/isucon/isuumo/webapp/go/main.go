@@ -2,15 +2,14 @@ package main
 
 import (
 	"database/sql"
-	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"sort"
 	"strconv"
 	"strings"
 
@@ -34,8 +33,9 @@ type InitializeResponse struct {
 }
 
 type ChairSearchResponse struct {
-	Count  int64   `json:"count"`
-	Chairs []Chair `json:"chairs"`
+	Count      int64   `json:"count"`
+	Chairs     []Chair `json:"chairs"`
+	NextCursor string  `json:"nextCursor,omitempty"`
 }
 
 type ChairListResponse struct {
@@ -60,8 +60,9 @@ type Estate struct {
 
 // EstateSearchResponse estate/searchへのレスポンスの形式
 type EstateSearchResponse struct {
-	Count   int64    `json:"count"`
-	Estates []Estate `json:"estates"`
+	Count      int64    `json:"count"`
+	Estates    []Estate `json:"estates"`
+	NextCursor string   `json:"nextCursor,omitempty"`
 }
 
 type EstateListResponse struct {
@@ -117,22 +118,41 @@ type MySQLConnectionEnv struct {
 
 type RecordMapper struct {
 	Record []string
+	// Header ヘッダー行があった場合の列の対応、nil なら列の順番通りに読む
+	Header *CSVHeader
 
 	offset int
 	err    error
 }
 
+func (r *RecordMapper) column() string {
+	if r.Header != nil {
+		return r.Header.Columns[r.offset-1].Name
+	}
+	return fmt.Sprintf("column %d", r.offset)
+}
+
 func (r *RecordMapper) next() (string, error) {
 	if r.err != nil {
 		return "", r.err
 	}
-	if r.offset >= len(r.Record) {
-		r.err = fmt.Errorf("too many read")
-		return "", r.err
+	pos := r.offset
+	if r.Header != nil {
+		if r.offset >= len(r.Header.Positions) {
+			r.err = fmt.Errorf("too many read")
+			return "", r.err
+		}
+		pos = r.Header.Positions[r.offset]
 	}
-	s := r.Record[r.offset]
 	r.offset++
-	return s, nil
+	if pos < 0 {
+		return "", nil
+	}
+	if pos >= len(r.Record) {
+		r.err = fmt.Errorf("%s: missing", r.column())
+		return "", r.err
+	}
+	return r.Record[pos], nil
 }
 
 func (r *RecordMapper) NextInt() int {
@@ -142,7 +162,7 @@ func (r *RecordMapper) NextInt() int {
 	}
 	i, err := strconv.Atoi(s)
 	if err != nil {
-		r.err = err
+		r.err = fmt.Errorf("%s: %v", r.column(), err)
 		return 0
 	}
 	return i
@@ -155,7 +175,7 @@ func (r *RecordMapper) NextFloat() float64 {
 	}
 	f, err := strconv.ParseFloat(s, 64)
 	if err != nil {
-		r.err = err
+		r.err = fmt.Errorf("%s: %v", r.column(), err)
 		return 0
 	}
 	return f
@@ -193,7 +213,7 @@ func getEnv(key, defaultValue string) string {
 
 // ConnectDB isuumoデータベースに接続する
 func (mc *MySQLConnectionEnv) ConnectDB() (*sqlx.DB, error) {
-	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v", mc.User, mc.Password, mc.Host, mc.Port, mc.DBName)
+	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?parseTime=true", mc.User, mc.Password, mc.Host, mc.Port, mc.DBName)
 	return sqlx.Open("mysql", dsn)
 }
 
@@ -227,25 +247,36 @@ func main() {
 	e.POST("/initialize", initialize)
 
 	// Chair Handler
+	e.GET("/api/chair/export", exportChairs)
 	e.GET("/api/chair/:id", getChairDetail)
 	e.POST("/api/chair", postChair)
+	e.DELETE("/api/chair/:id", deleteChair)
 	e.GET("/api/chair/search", searchChairs)
 	e.GET("/api/chair/low_priced", getLowPricedChair)
 	e.GET("/api/chair/search/condition", getChairSearchCondition)
-	e.POST("/api/chair/buy/:id", buyChair)
+	e.POST("/api/chair/buy/:id", buyChair, idempotent)
+	e.POST("/api/chair/checkout", checkoutChairs, idempotent)
+	e.POST("/api/chair/reserve/:id", reserveChair, idempotent)
+	e.POST("/api/chair/reservation/:id/confirm", confirmChairReservation, idempotent)
+	e.GET("/api/orders", getChairOrders)
 
 	// Estate Handler
+	e.GET("/api/estate/export", exportEstates)
 	e.GET("/api/estate/:id", getEstateDetail)
 	e.POST("/api/estate", postEstate)
+	e.DELETE("/api/estate/:id", deleteEstate)
 	e.GET("/api/estate/search", searchEstates)
 	e.GET("/api/estate/low_priced", getLowPricedEstate)
-	e.POST("/api/estate/req_doc/:id", postEstateRequestDocument)
+	e.POST("/api/estate/req_doc/:id", postEstateRequestDocument, idempotent)
 	e.POST("/api/estate/nazotte", searchEstateNazotte)
+	e.GET("/api/estate/nearby", searchEstatesNearby)
 	e.GET("/api/estate/search/condition", getEstateSearchCondition)
 	e.GET("/api/recommended_estate/:id", searchRecommendedEstateWithChair)
+	e.GET("/api/recommended_chair/:estateId", searchRecommendedChairWithEstate)
 
 	// for debug
 	e.GET("/debug/estate", debugEstate)
+	e.POST("/debug/estate/reload", reloadEstateCache)
 
 	mySQLConnectionData = NewMySQLConnectionEnv()
 
@@ -257,6 +288,21 @@ func main() {
 	db.SetMaxOpenConns(10)
 	defer db.Close()
 
+	if len(os.Args) > 1 && os.Args[1] == "repair-rent-category" {
+		n, err := repairRentCategory()
+		if err != nil {
+			e.Logger.Fatalf("repairRentCategory() : %v", err)
+		}
+		e.Logger.Infof("rent_category of %v estates repaired", n)
+		return
+	}
+
+	if err := checkChairRangeIDs(e.Logger); err != nil {
+		e.Logger.Errorf("checkChairRangeIDs() : %v", err)
+	}
+	go sweepChairReservations(e.Logger)
+	go sweepIdempotencyKeys(e.Logger)
+
 	// Start server
 	serverPort := fmt.Sprintf(":%v", getEnv("SERVER_PORT", "1323"))
 	e.Logger.Fatal(e.Start(serverPort))
@@ -288,11 +334,21 @@ func initialize(c echo.Context) error {
 		}
 	}
 
+	if _, err := repairRentCategory(); err != nil {
+		c.Logger().Errorf("repairRentCategory() : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	if err := updateEstateCache(); err != nil {
 		c.Logger().Errorf("updateEstateCache() : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	if err := updateChairCache(); err != nil {
+		c.Logger().Errorf("updateChairCache() : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "go",
 	})
@@ -332,28 +388,178 @@ func getRange(cond RangeCondition, rangeID string) (*Range, error) {
 	return cond.Ranges[RangeIndex], nil
 }
 
-func postEstate(c echo.Context) error {
-	defer func() {
-		if err := updateEstateCache(); err != nil {
-			c.Logger().Errorf("failed to update estate cache: %v", err)
+// rangeID v を含む Range の ID を getRange と同じ min 以上 max 未満の条件で探す、見つからなければ -1
+func rangeID(cond RangeCondition, v int64) int64 {
+	for _, r := range cond.Ranges {
+		if inRange(r, v) {
+			return r.ID
+		}
+	}
+	return -1
+}
+
+// rangeIDSQL rangeID と同じ判定をする CASE 式
+func rangeIDSQL(cond RangeCondition, column string) (string, []interface{}) {
+	whens := make([]string, 0, len(cond.Ranges))
+	params := make([]interface{}, 0, len(cond.Ranges)*3)
+	for _, r := range cond.Ranges {
+		switch {
+		case r.Min == -1 && r.Max == -1:
+			whens = append(whens, "WHEN TRUE THEN ?")
+		case r.Min == -1:
+			whens = append(whens, fmt.Sprintf("WHEN %s < ? THEN ?", column))
+			params = append(params, r.Max)
+		case r.Max == -1:
+			whens = append(whens, fmt.Sprintf("WHEN %s >= ? THEN ?", column))
+			params = append(params, r.Min)
+		default:
+			whens = append(whens, fmt.Sprintf("WHEN %s >= ? AND %s < ? THEN ?", column, column))
+			params = append(params, r.Min, r.Max)
 		}
-	}()
+		params = append(params, r.ID)
+	}
+	return fmt.Sprintf("(CASE %s ELSE -1 END)", strings.Join(whens, " ")), params
+}
+
+// rentCategory estate_condition.json の rent の範囲から rent_category を決める
+func rentCategory(rent int64) int64 {
+	return rangeID(estateSearchCondition.Rent, rent)
+}
+
+func estateFromRecord(rm *RecordMapper) (EstateCache, error) {
+	var e EstateCache
+	e.ID = int64(rm.NextInt())
+	e.Name = rm.NextString()
+	e.Description = rm.NextString()
+	e.Thumbnail = rm.NextString()
+	e.Address = rm.NextString()
+	e.Latitude = rm.NextFloat()
+	e.Longitude = rm.NextFloat()
+	e.Rent = int64(rm.NextInt())
+	e.DoorHeight = int64(rm.NextInt())
+	e.DoorWidth = int64(rm.NextInt())
+	e.Features = rm.NextString()
+	e.Popularity = int64(rm.NextInt())
+	if err := rm.Err(); err != nil {
+		return e, err
+	}
+	e.RentCategory = rentCategory(e.Rent)
+	return e, nil
+}
+
+// estateJSON JSON で取り込む物件、キーは API が返す Estate と同じで、返さない popularity を足したもの
+type estateJSON struct {
+	Estate
+	Popularity int64 `json:"popularity"`
+}
+
+// estateJSONRequired CSV の必須の列のうち、JSON でも必須のキー
+var estateJSONRequired = []string{"id", "name", "address", "latitude", "longitude", "rent", "doorHeight", "doorWidth"}
+
+func estateFromJSON(raw []byte, unknown map[string]bool) (EstateCache, error) {
+	var ej estateJSON
+	if err := decodeJSONRecord(raw, &ej, estateJSONRequired, unknown); err != nil {
+		return EstateCache{}, err
+	}
+	return EstateCache{
+		ID:           ej.ID,
+		Thumbnail:    ej.Thumbnail,
+		Name:         ej.Name,
+		Description:  ej.Description,
+		Latitude:     ej.Latitude,
+		Longitude:    ej.Longitude,
+		Address:      ej.Address,
+		Rent:         ej.Rent,
+		DoorHeight:   ej.DoorHeight,
+		DoorWidth:    ej.DoorWidth,
+		Features:     ej.Features,
+		Popularity:   ej.Popularity,
+		RentCategory: rentCategory(ej.Rent),
+	}, nil
+}
+
+func bulkInsertEstates(tx *sql.Tx, estates []EstateCache, upsert bool) error {
+	if len(estates) == 0 {
+		return nil
+	}
+	params := make([]interface{}, 0, len(estates)*13)
+	locationParams := make([]interface{}, 0, len(estates)*3)
+	for _, e := range estates {
+		params = append(params, e.ID, e.Name, e.Description, e.Thumbnail, e.Address, e.Latitude, e.Longitude, e.Rent, e.DoorHeight, e.DoorWidth, e.Features, e.Popularity, e.RentCategory)
+		locationParams = append(locationParams, e.ID, e.Longitude, e.Latitude)
+	}
+	query := bulkInsertSQL("estate", []string{"id", "name", "description", "thumbnail", "address", "latitude", "longitude", "rent", "door_height", "door_width", "features", "popularity", "rent_category"}, "(?,?,?,?,?,?,?,?,?,?,?,?,?)", len(estates), upsert)
+	if _, err := tx.Exec(query, params...); err != nil {
+		return err
+	}
+	query = bulkInsertSQL("estate_location", []string{"id", "location"}, "(?,POINT(?,?))", len(estates), upsert)
+	_, err := tx.Exec(query, locationParams...)
+	return err
+}
+
+// estateBatch CSV から読んだ物件をためて estate, estate_location にまとめて INSERT する
+type estateBatch struct {
+	tx       *sql.Tx
+	upsert   bool
+	rows     []EstateCache
+	inserted []EstateCache
+}
+
+func (b *estateBatch) Add(rm *RecordMapper) error {
+	e, err := estateFromRecord(rm)
+	if err != nil {
+		return err
+	}
+	b.rows = append(b.rows, e)
+	return nil
+}
 
-	header, err := c.FormFile("estates")
+func (b *estateBatch) AddJSON(raw []byte, unknown map[string]bool) error {
+	e, err := estateFromJSON(raw, unknown)
 	if err != nil {
-		c.Logger().Errorf("failed to get form file: %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		return err
 	}
-	f, err := header.Open()
+	b.rows = append(b.rows, e)
+	return nil
+}
+
+func (b *estateBatch) Len() int {
+	return len(b.rows)
+}
+
+func (b *estateBatch) Flush() error {
+	err := withSavepoint(b.tx, func() error { return bulkInsertEstates(b.tx, b.rows, b.upsert) })
 	if err != nil {
-		c.Logger().Errorf("failed to open form file: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return err
 	}
-	defer f.Close()
-	records, err := csv.NewReader(f).ReadAll()
+	b.inserted = append(b.inserted, b.rows...)
+	b.rows = b.rows[:0]
+	return nil
+}
+
+func (b *estateBatch) FlushRow(i int) error {
+	err := withSavepoint(b.tx, func() error { return bulkInsertEstates(b.tx, b.rows[i:i+1], b.upsert) })
 	if err != nil {
-		c.Logger().Errorf("failed to read csv: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return err
+	}
+	b.inserted = append(b.inserted, b.rows[i])
+	return nil
+}
+
+func (b *estateBatch) Reset() {
+	b.rows = b.rows[:0]
+}
+
+func postEstate(c echo.Context) error {
+	mode, err := parseImportMode(c)
+	if err != nil {
+		c.Logger().Infof("postEstate : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	upsert, err := parseUpsert(c)
+	if err != nil {
+		c.Logger().Infof("postEstate : %v", err)
+		return c.NoContent(http.StatusBadRequest)
 	}
 
 	tx, err := db.Begin()
@@ -362,175 +568,166 @@ func postEstate(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 	defer tx.Rollback()
-	for _, row := range records {
-		rm := RecordMapper{Record: row}
-		id := rm.NextInt()
-		name := rm.NextString()
-		description := rm.NextString()
-		thumbnail := rm.NextString()
-		address := rm.NextString()
-		latitude := rm.NextFloat()
-		longitude := rm.NextFloat()
-		rent := rm.NextInt()
-		doorHeight := rm.NextInt()
-		doorWidth := rm.NextInt()
-		features := rm.NextString()
-		popularity := rm.NextInt()
-		if err := rm.Err(); err != nil {
-			c.Logger().Errorf("failed to read record: %v", err)
-			return c.NoContent(http.StatusBadRequest)
-		}
-		rentCategory := 0
-		if rent <= 50000 {
-			rentCategory = 1
-		} else if rent <= 100000 {
-			rentCategory = 1
-		} else if rent <= 150000 {
-			rentCategory = 2
-		} else {
-			rentCategory = 3
-		}
-		_, err := tx.Exec("INSERT INTO estate(id, name, description, thumbnail, address, latitude, longitude, rent, door_height, door_width, features, popularity, rent_category) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?)", id, name, description, thumbnail, address, latitude, longitude, rent, doorHeight, doorWidth, features, popularity, rentCategory)
-		if err != nil {
-			c.Logger().Errorf("failed to insert estate: %v", err)
-			return c.NoContent(http.StatusInternalServerError)
-		}
-		_, err = tx.Exec("INSERT INTO estate_location(id, location) VALUES(?,POINT(?,?))", id, longitude, latitude)
-		if err != nil {
-			c.Logger().Errorf("failed to insert estate: %v", err)
-			return c.NoContent(http.StatusInternalServerError)
-		}
+
+	batch := &estateBatch{tx: tx, upsert: upsert}
+	report, err := importRequest(c, "estates", mode, estateCSVColumns, batch)
+	if errors.Is(err, errInvalidImportBody) {
+		c.Logger().Infof("postEstate : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if err != nil {
+		c.Logger().Errorf("failed to import estates: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
-	if err := tx.Commit(); err != nil {
+	if report.Failed() {
+		c.Logger().Infof("postEstate rejected %v lines", len(report.Rejected))
+		return c.JSON(http.StatusBadRequest, report)
+	}
+
+	if err := commitEstateCache(tx, batch.inserted, nil); err != nil {
 		c.Logger().Errorf("failed to commit tx: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	return c.NoContent(http.StatusCreated)
+	return c.JSON(http.StatusCreated, report)
 }
 
-func searchEstates(c echo.Context) error {
-	conditions := make([]string, 0)
-	params := make([]interface{}, 0)
+func parseEstateSearchFilter(c echo.Context) (EstateSearchFilter, error) {
+	var filter EstateSearchFilter
 
 	if c.QueryParam("doorHeightRangeId") != "" {
 		doorHeight, err := getRange(estateSearchCondition.DoorHeight, c.QueryParam("doorHeightRangeId"))
 		if err != nil {
-			c.Echo().Logger.Infof("doorHeightRangeID invalid, %v : %v", c.QueryParam("doorHeightRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
-		}
-
-		if doorHeight.Min != -1 {
-			conditions = append(conditions, "door_height >= ?")
-			params = append(params, doorHeight.Min)
-		}
-		if doorHeight.Max != -1 {
-			conditions = append(conditions, "door_height < ?")
-			params = append(params, doorHeight.Max)
+			return filter, fmt.Errorf("doorHeightRangeID invalid, %v : %v", c.QueryParam("doorHeightRangeId"), err)
 		}
+		filter.DoorHeight = doorHeight
 	}
 
 	if c.QueryParam("doorWidthRangeId") != "" {
 		doorWidth, err := getRange(estateSearchCondition.DoorWidth, c.QueryParam("doorWidthRangeId"))
 		if err != nil {
-			c.Echo().Logger.Infof("doorWidthRangeID invalid, %v : %v", c.QueryParam("doorWidthRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
-		}
-
-		if doorWidth.Min != -1 {
-			conditions = append(conditions, "door_width >= ?")
-			params = append(params, doorWidth.Min)
-		}
-		if doorWidth.Max != -1 {
-			conditions = append(conditions, "door_width < ?")
-			params = append(params, doorWidth.Max)
+			return filter, fmt.Errorf("doorWidthRangeID invalid, %v : %v", c.QueryParam("doorWidthRangeId"), err)
 		}
+		filter.DoorWidth = doorWidth
 	}
 
 	if c.QueryParam("rentRangeId") != "" {
-		rentRangeId := c.QueryParam("rentRangeId")
-		_, err := getRange(estateSearchCondition.Rent, rentRangeId)
+		rent, err := getRange(estateSearchCondition.Rent, c.QueryParam("rentRangeId"))
 		if err != nil {
-			c.Echo().Logger.Infof("rentRangeID invalid, %v : %v", c.QueryParam("rentRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
+			return filter, fmt.Errorf("rentRangeID invalid, %v : %v", c.QueryParam("rentRangeId"), err)
 		}
-
-		conditions = append(conditions, "rent_category = ?")
-		params = append(params, rentRangeId)
+		filter.Rent = rent
 	}
 
 	if c.QueryParam("features") != "" {
-		for _, f := range strings.Split(c.QueryParam("features"), ",") {
-			conditions = append(conditions, "features like concat('%', ?, '%')")
-			params = append(params, f)
-		}
+		filter.Features = strings.Split(c.QueryParam("features"), ",")
 	}
 
-	if len(conditions) == 0 {
-		c.Echo().Logger.Infof("searchEstates search condition not found")
+	return filter, nil
+}
+
+func deleteEstate(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	page, err := strconv.Atoi(c.QueryParam("page"))
+	tx, err := db.Begin()
 	if err != nil {
-		c.Logger().Infof("Invalid format page parameter : %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		c.Logger().Errorf("failed to begin tx: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
+	defer tx.Rollback()
 
-	perPage, err := strconv.Atoi(c.QueryParam("perPage"))
+	res, err := tx.Exec("DELETE FROM estate WHERE id = ?", id)
 	if err != nil {
-		c.Logger().Infof("Invalid format perPage parameter : %v", err)
+		c.Logger().Errorf("failed to delete estate: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		c.Echo().Logger.Infof("deleteEstate estate id %v not found", id)
+		return c.NoContent(http.StatusNotFound)
+	}
+	if _, err := tx.Exec("DELETE FROM estate_location WHERE id = ?", id); err != nil {
+		c.Logger().Errorf("failed to delete estate location: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := commitEstateCache(tx, nil, []int64{int64(id)}); err != nil {
+		c.Logger().Errorf("failed to commit tx: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func searchEstates(c echo.Context) error {
+	filter, err := parseEstateSearchFilter(c)
+	if err != nil {
+		c.Echo().Logger.Infof("%v", err)
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	searchQuery := "SELECT id, thumbnail, name, description, latitude, longitude, address, rent, door_height, door_width, features, popularity FROM estate WHERE "
-	countQuery := "SELECT COUNT(1) FROM estate WHERE "
-	searchCondition := strings.Join(conditions, " AND ")
-	limitOffset := " ORDER BY popularity DESC, id ASC LIMIT ? OFFSET ?"
+	if filter.empty() {
+		c.Echo().Logger.Infof("searchEstates search condition not found")
+		return c.NoContent(http.StatusBadRequest)
+	}
 
-	var res EstateSearchResponse
-	err = db.Get(&res.Count, countQuery+searchCondition, params...)
+	pagination, err := parsePagination(c)
 	if err != nil {
-		c.Logger().Errorf("searchEstates DB execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		c.Logger().Infof("Invalid pagination parameter : %v", err)
+		return c.NoContent(http.StatusBadRequest)
 	}
 
-	estates := []Estate{}
-	switch searchCondition {
-	case "rent_category = ?":
-		rentRangeID := c.QueryParam("rentRangeId")
-		for _, e := range estateCache {
-			if strconv.Itoa(int(e.RentCategory)) == rentRangeID {
-				estates = append(estates, e.Estate())
-			}
-		}
-		sort.Slice(estates, func(i, j int) bool {
-			if estates[i].Popularity == estates[j].Popularity {
-				return estates[i].ID < estates[j].ID
-			}
-			return estates[i].Popularity > estates[j].Popularity
-		})
-		left := perPage
-		right := left + page*perPage
-		if right > len(estates) {
-			right = len(estates)
+	var res EstateSearchResponse
+	if snapshot := currentEstateCache(); snapshot != nil {
+		res.Count, res.Estates, err = snapshot.Index.Search(filter, pagination)
+		if err != nil {
+			c.Logger().Errorf("searchEstates index error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
 		}
-		estates = estates[left:right]
-	default:
-		params = append(params, perPage, page*perPage)
-		err = db.Select(&estates, searchQuery+searchCondition+limitOffset, params...)
+	} else {
+		searchCondition, params := filter.sql()
+		res.Count, res.Estates, err = searchEstatesSQL(searchCondition, params, pagination)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				return c.JSON(http.StatusOK, EstateSearchResponse{Count: 0, Estates: []Estate{}})
-			}
 			c.Logger().Errorf("searchEstates DB execution error : %v", err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
 	}
-	res.Estates = estates
+	res.NextCursor = estatesNextCursor(pagination, res.Estates)
 
 	return c.JSON(http.StatusOK, res)
 }
 
+// searchEstatesSQL searchCondition に一致する物件の総数と指定ページの物件を DB から取得する
+func searchEstatesSQL(searchCondition string, params []interface{}, pagination Pagination) (int64, []Estate, error) {
+	searchQuery := "SELECT id, thumbnail, name, description, latitude, longitude, address, rent, door_height, door_width, features, popularity FROM estate WHERE "
+	countQuery := "SELECT COUNT(1) FROM estate WHERE "
+	orderBy := " ORDER BY popularity DESC, id ASC"
+
+	var count int64
+	err := db.Get(&count, countQuery+searchCondition, params...)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	estates := []Estate{}
+	keyset, params := pagination.KeysetSQL(params)
+	limitOffset, params := pagination.SQL(params)
+	err = db.Select(&estates, searchQuery+searchCondition+keyset+orderBy+limitOffset, params...)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, nil, err
+	}
+	return count, estates, nil
+}
+
+func estatesNextCursor(p Pagination, estates []Estate) string {
+	if len(estates) == 0 {
+		return ""
+	}
+	last := estates[len(estates)-1]
+	return p.NextCursor(len(estates), Cursor{Popularity: last.Popularity, ID: last.ID})
+}
+
 func getLowPricedEstate(c echo.Context) error {
 	estates := make([]Estate, 0, Limit)
 	query := `SELECT id, thumbnail, name, description, latitude, longitude, address, rent, door_height, door_width, features, popularity FROM estate ORDER BY rent ASC, id ASC LIMIT ?`
@@ -554,69 +751,90 @@ func searchRecommendedEstateWithChair(c echo.Context) error {
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	chair := Chair{}
-	query := `SELECT id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock FROM chair WHERE id = ?`
-	err = db.Get(&chair, query, id)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			c.Logger().Infof("Requested chair id \"%v\" not found", id)
-			return c.NoContent(http.StatusBadRequest)
+	chair, found, ok := chairCache.Lookup(int64(id))
+	if !ok {
+		query := `SELECT id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock FROM chair WHERE id = ?`
+		err = db.Get(&chair, query, id)
+		if err == nil {
+			found = true
+		} else if err != sql.ErrNoRows {
+			c.Logger().Errorf("Database execution error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
 		}
-		c.Logger().Errorf("Database execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !found {
+		c.Logger().Infof("Requested chair id \"%v\" not found", id)
+		return c.NoContent(http.StatusBadRequest)
 	}
 
-	var estates []Estate
-	w := chair.Width
-	h := chair.Height
-	d := chair.Depth
-	chairMin := minInt(w, h, d)
-	chairMax := maxInt(w, h, d)
-	chairMid := w + h + d - chairMin - chairMax
-	query = `SELECT id, thumbnail, name, description, latitude, longitude, address, rent, door_height, door_width, features, popularity FROM estate WHERE (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) ORDER BY popularity DESC, id ASC LIMIT ?`
-	err = db.Select(&estates, query, chairMin, chairMid, chairMid, chairMin, Limit)
+	opt, err := parseFitOptions(c)
+	if err != nil {
+		c.Logger().Infof("searchRecommendedEstateWithChair %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	if snapshot := currentEstateCache(); snapshot != nil {
+		return c.JSON(http.StatusOK, RecommendedEstateResponse{Estates: snapshot.Index.RecommendedFor(chair, opt, Limit)})
+	}
+
+	estates, err := recommendedEstatesSQL(chair, opt, Limit)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return c.JSON(http.StatusOK, EstateListResponse{[]Estate{}})
-		}
 		c.Logger().Errorf("Database execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	return c.JSON(http.StatusOK, EstateListResponse{Estates: estates})
+	return c.JSON(http.StatusOK, RecommendedEstateResponse{Estates: estates})
 }
 
 func searchEstateNazotte(c echo.Context) error {
-	coordinates := Coordinates{}
-	err := c.Bind(&coordinates)
+	req := ShapeRequest{}
+	err := c.Bind(&req)
 	if err != nil {
 		c.Echo().Logger.Infof("post search estate nazotte failed : %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		return c.JSON(http.StatusBadRequest, &PolygonError{Reason: fmt.Sprintf("malformed request : %v", err)})
+	}
+
+	shape, perr := req.Shape()
+	if perr != nil {
+		c.Echo().Logger.Infof("post search estate nazotte failed : %v", perr)
+		return c.JSON(http.StatusBadRequest, perr)
+	}
+
+	if err := shape.validate(); err != nil {
+		c.Echo().Logger.Infof("post search estate nazotte invalid polygon : %v", err)
+		return c.JSON(http.StatusBadRequest, err)
 	}
 
-	if len(coordinates.Coordinates) == 0 {
+	filter, err := parseEstateSearchFilter(c)
+	if err != nil {
+		c.Echo().Logger.Infof("%v", err)
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	estatesInPolygon, err := listEstatesInPolygon(c, coordinates)
-	if err == sql.ErrNoRows {
-		c.Echo().Logger.Infof("select id, thumbnail, name, description, latitude, longitude, address, rent, door_height, door_width, features, popularity from estate where latitude ...", err)
-		return c.JSON(http.StatusOK, EstateSearchResponse{Count: 0, Estates: []Estate{}})
-	} else if err != nil {
-		c.Echo().Logger.Errorf("database execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+	// page, perPage, cursor が無い場合は従来通り先頭の NazotteLimit 件を返す
+	pagination, err := parseOptionalPagination(c, NazotteLimit)
+	if err != nil {
+		c.Logger().Infof("Invalid pagination parameter : %v", err)
+		return c.NoContent(http.StatusBadRequest)
 	}
 
-	var re EstateSearchResponse
-	re.Estates = []Estate{}
-	if len(estatesInPolygon) > NazotteLimit {
-		re.Estates = estatesInPolygon[:NazotteLimit]
+	var res EstateSearchResponse
+	if snapshot := currentEstateCache(); snapshot != nil {
+		res.Count, res.Estates, err = snapshot.Index.InShape(shape, filter, pagination)
+		if err != nil {
+			c.Logger().Errorf("searchEstateNazotte index error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
 	} else {
-		re.Estates = estatesInPolygon
+		res.Count, res.Estates, err = listEstatesInShape(shape, filter, pagination)
+		if err != nil {
+			c.Echo().Logger.Errorf("database execution error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
 	}
-	re.Count = int64(len(re.Estates))
+	res.NextCursor = estatesNextCursor(pagination, res.Estates)
 
-	return c.JSON(http.StatusOK, re)
+	return c.JSON(http.StatusOK, res)
 }
 
 func postEstateRequestDocument(c echo.Context) error {
@@ -683,39 +901,3 @@ func (cs Coordinates) getBoundingBox() BoundingBox {
 	}
 	return boundingBox
 }
-
-func (cs Coordinates) coordinatesToText() string {
-	points := make([]string, 0, len(cs.Coordinates))
-	for _, c := range cs.Coordinates {
-		points = append(points, fmt.Sprintf("%f %f", c.Latitude, c.Longitude))
-	}
-	return fmt.Sprintf("'POLYGON((%s))'", strings.Join(points, ","))
-}
-
-func (cs Coordinates) coordinatesToText2() string {
-	points := make([]string, 0, len(cs.Coordinates))
-	for _, c := range cs.Coordinates {
-		points = append(points, fmt.Sprintf("%f %f", c.Longitude, c.Latitude))
-	}
-	return fmt.Sprintf("'POLYGON((%s))'", strings.Join(points, ","))
-}
-
-func minInt(a, b, c int64) int64 {
-	if a < b && b < c {
-		return a
-	} else if b < c {
-		return b
-	} else {
-		return c
-	}
-}
-
-func maxInt(a, b, c int64) int64 {
-	if a < c && b < c {
-		return c
-	} else if b < a {
-		return a
-	} else {
-		return b
-	}
-}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openTestDB ISUUMO_TEST_MYSQL が設定されているときだけ MYSQL_* の DB に接続し、0_Schema.sql のテーブルを作り直す
+// テーブルを消すので MYSQL_DBNAME=isuumo_test のようにテスト用の DB を指定して使う
+func openTestDB(t *testing.T) {
+	t.Helper()
+	if os.Getenv("ISUUMO_TEST_MYSQL") == "" {
+		t.Skip("ISUUMO_TEST_MYSQL is not set")
+	}
+
+	var err error
+	db, err = NewMySQLConnectionEnv().ConnectDB()
+	if err != nil {
+		t.Fatalf("DB connection failed : %v", err)
+	}
+	db.SetMaxOpenConns(10)
+	t.Cleanup(func() {
+		db.Close()
+		db = nil
+		estateCache.Store((*EstateSnapshot)(nil))
+		chairCache = &ChairCache{}
+	})
+
+	schema, err := ioutil.ReadFile(filepath.Join("..", "mysql", "db", "0_Schema.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range strings.Split(string(schema), ";") {
+		stmt = strings.TrimSpace(stmt)
+		if stmt == "" || strings.HasSuffix(stmt, "DATABASE isuumo") || strings.HasSuffix(stmt, "DATABASE IF EXISTS isuumo") {
+			continue
+		}
+		if _, err := db.Exec(strings.Replace(stmt, "isuumo.", "", -1)); err != nil {
+			t.Fatalf("%v : %v", stmt, err)
+		}
+	}
+}
+
+// testEstates popularity が重なるように作った n 件の物件
+func testEstates(n int) []EstateCache {
+	r := rand.New(rand.NewSource(1))
+	features := estateSearchCondition.Feature.List
+	estates := make([]EstateCache, n)
+	for i := range estates {
+		e := EstateCache{
+			ID:          int64(i + 1),
+			Name:        fmt.Sprintf("estate %d", i+1),
+			Description: "description",
+			Thumbnail:   fmt.Sprintf("/images/estate/%d.png", i+1),
+			Address:     "東京都",
+			Latitude:    35.5 + r.Float64()*0.3,
+			Longitude:   139.5 + r.Float64()*0.3,
+			Rent:        int64(r.Intn(200000)),
+			DoorHeight:  int64(50 + r.Intn(150)),
+			DoorWidth:   int64(50 + r.Intn(150)),
+			Popularity:  int64(r.Intn(n/4 + 1)),
+		}
+		if r.Intn(2) == 0 {
+			e.Features = features[r.Intn(len(features))] + "," + features[r.Intn(len(features))]
+		}
+		e.RentCategory = rentCategory(e.Rent)
+		estates[i] = e
+	}
+	return estates
+}
+
+// testChairs popularity が重なり、在庫切れを含む n 件の椅子
+func testChairs(n int) []Chair {
+	r := rand.New(rand.NewSource(2))
+	features := chairSearchCondition.Feature.List
+	colors := chairSearchCondition.Color.List
+	kinds := chairSearchCondition.Kind.List
+	chairs := make([]Chair, n)
+	for i := range chairs {
+		chair := Chair{
+			ID:          int64(i + 1),
+			Name:        fmt.Sprintf("chair %d", i+1),
+			Description: "description",
+			Thumbnail:   fmt.Sprintf("/images/chair/%d.png", i+1),
+			Price:       int64(1000 + r.Intn(17000)),
+			Height:      int64(50 + r.Intn(150)),
+			Width:       int64(50 + r.Intn(150)),
+			Depth:       int64(50 + r.Intn(150)),
+			Color:       colors[r.Intn(len(colors))],
+			Kind:        kinds[r.Intn(len(kinds))],
+			Popularity:  int64(r.Intn(n/4 + 1)),
+			Stock:       int64(r.Intn(4)),
+		}
+		if r.Intn(2) == 0 {
+			chair.Features = features[r.Intn(len(features))]
+		}
+		chairs[i] = chair
+	}
+	return chairs
+}
+
+func insertTestEstates(t *testing.T, estates []EstateCache) {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := bulkInsertEstates(tx, estates, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func insertTestChairs(t *testing.T, chairs []Chair) {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := bulkInsertChairs(tx, chairs, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
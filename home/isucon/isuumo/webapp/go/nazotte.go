@@ -0,0 +1,148 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+)
+
+// nazotteGridSize グリッドの1マスの大きさ (度)
+const nazotteGridSize = 0.01
+
+type gridCell struct {
+	Lat int
+	Lng int
+}
+
+func gridCellOf(latitude, longitude float64) gridCell {
+	return gridCell{
+		Lat: int(math.Floor(latitude / nazotteGridSize)),
+		Lng: int(math.Floor(longitude / nazotteGridSize)),
+	}
+}
+
+// estateGrid 緯度経度のマスごとに、そのマスにある物件のインデックス上の位置を持つ
+type estateGrid map[gridCell][]int
+
+func newEstateGrid(estates []EstateCache) estateGrid {
+	grid := estateGrid{}
+	for i := range estates {
+		cell := gridCellOf(estates[i].Latitude, estates[i].Longitude)
+		grid[cell] = append(grid[cell], i)
+	}
+	return grid
+}
+
+// candidates bb と重なるマスにある物件を表すビットマップ
+func (g estateGrid) candidates(bb BoundingBox, n int) bitmap {
+	b := newBitmap(n)
+	lo := gridCellOf(bb.TopLeftCorner.Latitude, bb.TopLeftCorner.Longitude)
+	hi := gridCellOf(bb.BottomRightCorner.Latitude, bb.BottomRightCorner.Longitude)
+	cells := (hi.Lat - lo.Lat + 1) * (hi.Lng - lo.Lng + 1)
+	if cells > len(g) {
+		for cell, positions := range g {
+			if lo.Lat <= cell.Lat && cell.Lat <= hi.Lat && lo.Lng <= cell.Lng && cell.Lng <= hi.Lng {
+				for _, i := range positions {
+					b.set(i)
+				}
+			}
+		}
+		return b
+	}
+	for lat := lo.Lat; lat <= hi.Lat; lat++ {
+		for lng := lo.Lng; lng <= hi.Lng; lng++ {
+			for _, i := range g[gridCell{Lat: lat, Lng: lng}] {
+				b.set(i)
+			}
+		}
+	}
+	return b
+}
+
+// ringLocate 点がリングの外なら -1 、境界上なら 0 、内側なら 1
+func ringLocate(ring []Coordinate, p Coordinate) int {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if orientation(a, b, p) == 0 && onSegment(a, b, p) {
+			return 0
+		}
+		if (a.Latitude > p.Latitude) != (b.Latitude > p.Latitude) &&
+			p.Longitude < (b.Longitude-a.Longitude)*(p.Latitude-a.Latitude)/(b.Latitude-a.Latitude)+a.Longitude {
+			inside = !inside
+		}
+	}
+	if inside {
+		return 1
+	}
+	return -1
+}
+
+// polygonIndex ポリゴンの判定に使うリングと外周のバウンディングボックス
+type polygonIndex struct {
+	rings [][]Coordinate
+	bb    BoundingBox
+}
+
+// contains ST_Contains と同じく外周と穴の境界上の点は含まない
+func (pi polygonIndex) contains(p Coordinate) bool {
+	if !pi.bb.contains(p) || ringLocate(pi.rings[0], p) <= 0 {
+		return false
+	}
+	for _, hole := range pi.rings[1:] {
+		if ringLocate(hole, p) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Shape) polygonIndexes() []polygonIndex {
+	indexes := make([]polygonIndex, 0, len(s.Polygons))
+	for _, polygon := range s.Polygons {
+		pi := polygonIndex{bb: polygon[0].getBoundingBox()}
+		for _, ring := range polygon {
+			pi.rings = append(pi.rings, ring.ring())
+		}
+		indexes = append(indexes, pi)
+	}
+	return indexes
+}
+
+func (bb BoundingBox) contains(p Coordinate) bool {
+	return bb.TopLeftCorner.Latitude <= p.Latitude && p.Latitude <= bb.BottomRightCorner.Latitude &&
+		bb.TopLeftCorner.Longitude <= p.Longitude && p.Longitude <= bb.BottomRightCorner.Longitude
+}
+
+// InShape 図形に含まれ、検索条件に一致する物件の総数と指定ページの物件を返す
+func (idx *EstateIndex) InShape(s Shape, f EstateSearchFilter, p Pagination) (int64, []Estate, error) {
+	acc, err := idx.match(f)
+	if err != nil {
+		return 0, nil, err
+	}
+	polygons := s.polygonIndexes()
+	candidates := newBitmap(len(idx.estates))
+	for _, pi := range polygons {
+		candidates.or(idx.grid.candidates(pi.bb, len(idx.estates)))
+	}
+	acc.and(candidates)
+	for w, x := range acc {
+		for x != 0 {
+			t := x & -x
+			x &= x - 1
+			e := &idx.estates[w<<6+bits.TrailingZeros64(t)]
+			pt := Coordinate{Latitude: e.Latitude, Longitude: e.Longitude}
+			contained := false
+			for _, pi := range polygons {
+				if pi.contains(pt) {
+					contained = true
+					break
+				}
+			}
+			if !contained {
+				acc[w] &^= t
+			}
+		}
+	}
+	count, estates := idx.page(acc, p)
+	return count, estates, nil
+}
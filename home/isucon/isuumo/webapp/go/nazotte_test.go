@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func testRing(points ...[2]float64) Coordinates {
+	cs := Coordinates{}
+	for _, p := range points {
+		cs.Coordinates = append(cs.Coordinates, Coordinate{Latitude: p[0], Longitude: p[1]})
+	}
+	return cs
+}
+
+func testShapes() map[string]Shape {
+	concave := testRing([2]float64{35.55, 139.55}, [2]float64{35.75, 139.55}, [2]float64{35.65, 139.65}, [2]float64{35.75, 139.75}, [2]float64{35.55, 139.75})
+	outer := testRing([2]float64{35.52, 139.52}, [2]float64{35.78, 139.52}, [2]float64{35.78, 139.78}, [2]float64{35.52, 139.78})
+	hole := testRing([2]float64{35.6, 139.6}, [2]float64{35.7, 139.6}, [2]float64{35.7, 139.7}, [2]float64{35.6, 139.7})
+	west := testRing([2]float64{35.5, 139.5}, [2]float64{35.6, 139.5}, [2]float64{35.6, 139.6}, [2]float64{35.5, 139.6})
+	east := testRing([2]float64{35.7, 139.7}, [2]float64{35.8, 139.7}, [2]float64{35.8, 139.8}, [2]float64{35.7, 139.8})
+	return map[string]Shape{
+		"concave":      {Polygons: []Polygon{{concave}}},
+		"hole":         {Polygons: []Polygon{{outer, hole}}},
+		"multipolygon": {Polygons: []Polygon{{west}, {east}}},
+	}
+}
+
+func TestPolygonIndexBoundary(t *testing.T) {
+	pi := testShapes()["hole"].polygonIndexes()[0]
+	tests := []struct {
+		p    Coordinate
+		want bool
+	}{
+		{p: Coordinate{Latitude: 35.55, Longitude: 139.55}, want: true},
+		{p: Coordinate{Latitude: 35.65, Longitude: 139.65}, want: false},
+		{p: Coordinate{Latitude: 35.52, Longitude: 139.6}, want: false},
+		{p: Coordinate{Latitude: 35.6, Longitude: 139.65}, want: false},
+		{p: Coordinate{Latitude: 35.9, Longitude: 139.65}, want: false},
+	}
+	for _, tt := range tests {
+		if got := pi.contains(tt.p); got != tt.want {
+			t.Errorf("contains(%+v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+}
+
+// TestInShapeMatchesSQL なぞって検索のインデックスの結果が MySQL の ST_Contains と一致するか
+func TestInShapeMatchesSQL(t *testing.T) {
+	openTestDB(t)
+	estates := testEstates(600)
+	insertTestEstates(t, estates)
+	index := newEstateIndex(estates)
+
+	cursors := []Cursor{
+		{Popularity: estates[10].Popularity, ID: estates[10].ID},
+		{Popularity: estates[500].Popularity, ID: estates[500].ID},
+		{Popularity: -1, ID: 0},
+	}
+	filters := []EstateSearchFilter{
+		{},
+		{Rent: estateSearchCondition.Rent.Ranges[2]},
+		{DoorWidth: estateSearchCondition.DoorWidth.Ranges[2], DoorHeight: estateSearchCondition.DoorHeight.Ranges[3]},
+		{Features: []string{estateSearchCondition.Feature.List[0]}},
+	}
+	paginations := append(testPaginations(t, cursors), Pagination{PerPage: NazotteLimit})
+	for name, shape := range testShapes() {
+		if err := shape.validate(); err != nil {
+			t.Fatalf("%v : %v", name, err)
+		}
+		for _, f := range filters {
+			for _, p := range paginations {
+				count, got, err := index.InShape(shape, f, p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantCount, want, err := listEstatesInShape(shape, f, p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if count == 0 && reflect.DeepEqual(f, EstateSearchFilter{}) {
+					t.Errorf("%v : no estate in the shape, the fixture does not cover it", name)
+				}
+				if count != wantCount || !reflect.DeepEqual(got, want) {
+					t.Errorf("%v, filter %+v, pagination %+v : index returned %v %v, SQL returned %v %v", name, f, p, count, got, wantCount, want)
+				}
+			}
+		}
+	}
+}
+
+func estateIDs(estates []Estate) []int64 {
+	ids := make([]int64, len(estates))
+	for i, e := range estates {
+		ids[i] = e.ID
+	}
+	return ids
+}
+
+func TestSearchEstateNazottePagination(t *testing.T) {
+	estates := testEstates(600)
+	publishTestEstates(t, estates)
+	index := newEstateIndex(estates)
+	shape := testShapes()["concave"]
+	body := `{"coordinates": [{"latitude": 35.55, "longitude": 139.55}, {"latitude": 35.75, "longitude": 139.55}, {"latitude": 35.65, "longitude": 139.65}, {"latitude": 35.75, "longitude": 139.75}, {"latitude": 35.55, "longitude": 139.75}]}`
+
+	_, first, err := index.InShape(shape, EstateSearchFilter{}, Pagination{PerPage: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor := Cursor{Popularity: first[4].Popularity, ID: first[4].ID}
+
+	tests := []struct {
+		query string
+		want  Pagination
+		code  int
+	}{
+		{query: "", want: Pagination{PerPage: NazotteLimit}},
+		{query: "?page=2", want: Pagination{Page: 2, PerPage: NazotteLimit}},
+		{query: "?perPage=10", want: Pagination{PerPage: 10}},
+		{query: "?page=1&perPage=10", want: Pagination{Page: 1, PerPage: 10}},
+		{query: "?cursor=" + cursor.String(), want: Pagination{PerPage: NazotteLimit, After: &cursor}},
+		{query: "?cursor=" + cursor.String() + "&perPage=3", want: Pagination{PerPage: 3, After: &cursor}},
+		{query: "?page=x", code: http.StatusBadRequest},
+		{query: "?perPage=0", code: http.StatusBadRequest},
+		{query: "?cursor=!", code: http.StatusBadRequest},
+	}
+	e := echo.New()
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/estate/nazotte"+tt.query, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		if err := searchEstateNazotte(e.NewContext(req, rec)); err != nil {
+			t.Fatal(err)
+		}
+		if tt.code != 0 {
+			if rec.Code != tt.code {
+				t.Errorf("%q : status = %v, want %v", tt.query, rec.Code, tt.code)
+			}
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			t.Errorf("%q : status = %v", tt.query, rec.Code)
+			continue
+		}
+		var res EstateSearchResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		count, want, err := index.InShape(shape, EstateSearchFilter{}, tt.want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(want) == 0 {
+			t.Fatalf("%q : the fixture has no estate on this page", tt.query)
+		}
+		// popularity は JSON に含まれないので id で比べる
+		if res.Count != count || !reflect.DeepEqual(estateIDs(res.Estates), estateIDs(want)) {
+			t.Errorf("%q : got %v %v, want %v %v", tt.query, res.Count, estateIDs(res.Estates), count, estateIDs(want))
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// earthRadiusMeters MySQL の ST_Distance_Sphere と同じ地球の半径
+const earthRadiusMeters = 6370986
+
+// EstateWithDistance 検索地点からの距離 (メートル) 付きの物件
+type EstateWithDistance struct {
+	Estate
+	Distance float64 `db:"distance" json:"distance"`
+}
+
+type EstateNearbyResponse struct {
+	Count   int64                `json:"count"`
+	Estates []EstateWithDistance `json:"estates"`
+}
+
+// NearbyQuery radiusMeters だけなら半径内を距離順にページングし、k があれば近い順に k 件返す
+type NearbyQuery struct {
+	Center       Coordinate
+	RadiusMeters float64
+	K            int
+}
+
+func distanceMeters(a, b Coordinate) float64 {
+	lat1 := a.Latitude * math.Pi / 180
+	lat2 := b.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLng := (b.Longitude - a.Longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// boundingBox 半径 radiusMeters の円を囲む範囲、極や日付変更線をまたぐ場合は全体を返す
+func (q NearbyQuery) boundingBox() (BoundingBox, bool) {
+	angle := q.RadiusMeters / earthRadiusMeters
+	dLat := angle * 180 / math.Pi
+	cos := math.Cos(q.Center.Latitude * math.Pi / 180)
+	if q.Center.Latitude+dLat >= 90 || q.Center.Latitude-dLat <= -90 || math.Sin(angle) >= cos {
+		return BoundingBox{}, false
+	}
+	dLng := math.Asin(math.Sin(angle)/cos) * 180 / math.Pi
+	if q.Center.Longitude+dLng >= 180 || q.Center.Longitude-dLng <= -180 {
+		return BoundingBox{}, false
+	}
+	return BoundingBox{
+		TopLeftCorner:     Coordinate{Latitude: q.Center.Latitude - dLat, Longitude: q.Center.Longitude - dLng},
+		BottomRightCorner: Coordinate{Latitude: q.Center.Latitude + dLat, Longitude: q.Center.Longitude + dLng},
+	}, true
+}
+
+func sortByDistance(estates []EstateWithDistance) {
+	sort.SliceStable(estates, func(i, j int) bool {
+		return estates[i].Distance < estates[j].Distance
+	})
+}
+
+// Nearby popularity DESC, id ASC の並びを保ったまま距離で安定ソートする
+func (idx *EstateIndex) Nearby(q NearbyQuery, f EstateSearchFilter, p Pagination) (int64, []EstateWithDistance, error) {
+	acc, err := idx.match(f)
+	if err != nil {
+		return 0, nil, err
+	}
+	if q.RadiusMeters > 0 {
+		if bb, ok := q.boundingBox(); ok {
+			acc.and(idx.grid.candidates(bb, len(idx.estates)))
+		}
+	}
+
+	estates := []EstateWithDistance{}
+	for w, x := range acc {
+		for x != 0 {
+			e := &idx.estates[w<<6+bits.TrailingZeros64(x)]
+			x &= x - 1
+			d := distanceMeters(q.Center, Coordinate{Latitude: e.Latitude, Longitude: e.Longitude})
+			if q.RadiusMeters > 0 && d > q.RadiusMeters {
+				continue
+			}
+			estates = append(estates, EstateWithDistance{Estate: e.Estate(), Distance: d})
+		}
+	}
+	sortByDistance(estates)
+
+	if q.K > 0 {
+		if len(estates) > q.K {
+			estates = estates[:q.K]
+		}
+		return int64(len(estates)), estates, nil
+	}
+	count := len(estates)
+	left := p.Offset()
+	if left > count {
+		left = count
+	}
+	right := left + p.Limit()
+	if right > count {
+		right = count
+	}
+	return int64(count), estates[left:right], nil
+}
+
+func nearbyEstatesSQL(q NearbyQuery, f EstateSearchFilter, p Pagination) (int64, []EstateWithDistance, error) {
+	searchCondition, params := f.sql()
+	distance := "ST_Distance_Sphere(estate_location.location, POINT(?, ?))"
+	params = append([]interface{}{q.Center.Longitude, q.Center.Latitude}, params...)
+	if q.RadiusMeters > 0 {
+		searchCondition += " AND " + distance + " <= ?"
+		params = append(params, q.Center.Longitude, q.Center.Latitude, q.RadiusMeters)
+	}
+	from := " FROM estate JOIN estate_location ON estate.id = estate_location.id WHERE " + searchCondition
+	searchQuery := "SELECT estate.id, estate.thumbnail, estate.name, estate.description, estate.latitude, estate.longitude, estate.address, estate.rent, estate.door_height, estate.door_width, estate.features, estate.popularity, " + distance + " AS distance" + from
+	orderBy := " ORDER BY distance ASC, estate.popularity DESC, estate.id ASC LIMIT ? OFFSET ?"
+
+	estates := []EstateWithDistance{}
+	if q.K > 0 {
+		err := db.Select(&estates, searchQuery+orderBy, append(params, q.K, 0)...)
+		return int64(len(estates)), estates, err
+	}
+
+	var count int64
+	if err := db.Get(&count, "SELECT COUNT(1)"+from, params[2:]...); err != nil {
+		return 0, nil, err
+	}
+	err := db.Select(&estates, searchQuery+orderBy, append(params, p.Limit(), p.Offset())...)
+	return count, estates, err
+}
+
+func parseNearbyQuery(c echo.Context) (NearbyQuery, error) {
+	var q NearbyQuery
+	lat, err := strconv.ParseFloat(c.QueryParam("lat"), 64)
+	if err != nil || lat < -90 || 90 < lat {
+		return q, fmt.Errorf("lat invalid : %v", c.QueryParam("lat"))
+	}
+	lng, err := strconv.ParseFloat(c.QueryParam("lng"), 64)
+	if err != nil || lng < -180 || 180 < lng {
+		return q, fmt.Errorf("lng invalid : %v", c.QueryParam("lng"))
+	}
+	q.Center = Coordinate{Latitude: lat, Longitude: lng}
+
+	if c.QueryParam("radiusMeters") != "" {
+		q.RadiusMeters, err = strconv.ParseFloat(c.QueryParam("radiusMeters"), 64)
+		if err != nil || q.RadiusMeters <= 0 {
+			return q, fmt.Errorf("radiusMeters invalid : %v", c.QueryParam("radiusMeters"))
+		}
+	}
+	if c.QueryParam("k") != "" {
+		q.K, err = strconv.Atoi(c.QueryParam("k"))
+		if err != nil || q.K <= 0 {
+			return q, fmt.Errorf("k invalid : %v", c.QueryParam("k"))
+		}
+		if q.K > MaxPerPage {
+			q.K = MaxPerPage
+		}
+	}
+	if q.RadiusMeters == 0 && q.K == 0 {
+		return q, fmt.Errorf("radiusMeters or k is required")
+	}
+	return q, nil
+}
+
+func searchEstatesNearby(c echo.Context) error {
+	q, err := parseNearbyQuery(c)
+	if err != nil {
+		c.Echo().Logger.Infof("searchEstatesNearby %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	filter, err := parseEstateSearchFilter(c)
+	if err != nil {
+		c.Echo().Logger.Infof("%v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	pagination := Pagination{PerPage: Limit}
+	if c.QueryParam("perPage") != "" {
+		pagination, err = parsePagination(c)
+		if err == nil && pagination.After != nil {
+			err = fmt.Errorf("cursor is not supported")
+		}
+		if err != nil {
+			c.Logger().Infof("Invalid pagination parameter : %v", err)
+			return c.NoContent(http.StatusBadRequest)
+		}
+	}
+
+	var res EstateNearbyResponse
+	if snapshot := currentEstateCache(); snapshot != nil {
+		res.Count, res.Estates, err = snapshot.Index.Nearby(q, filter, pagination)
+		if err != nil {
+			c.Logger().Errorf("searchEstatesNearby index error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	} else {
+		res.Count, res.Estates, err = nearbyEstatesSQL(q, filter, pagination)
+		if err != nil {
+			c.Logger().Errorf("searchEstatesNearby DB execution error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
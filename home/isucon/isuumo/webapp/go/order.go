@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+// ChairOrder 椅子の購入記録、price は購入時点の1個あたりの価格
+type ChairOrder struct {
+	ID        int64     `db:"id" json:"id"`
+	ChairID   int64     `db:"chair_id" json:"chairId"`
+	Email     string    `db:"email" json:"email"`
+	Price     int64     `db:"price" json:"price"`
+	Quantity  int64     `db:"quantity" json:"quantity"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+type ChairOrderListResponse struct {
+	Orders []ChairOrder `json:"orders"`
+}
+
+// insertChairOrder 在庫を減らしたのと同じトランザクションで購入記録を残す
+func insertChairOrder(tx *sqlx.Tx, chair *Chair, email string, quantity int64) (ChairOrder, error) {
+	order := ChairOrder{
+		ChairID:   chair.ID,
+		Email:     email,
+		Price:     chair.Price,
+		Quantity:  quantity,
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+	}
+	res, err := tx.Exec("INSERT INTO chair_order(chair_id, email, price, quantity, created_at) VALUES (?, ?, ?, ?, ?)", order.ChairID, order.Email, order.Price, order.Quantity, order.CreatedAt)
+	if err != nil {
+		return order, err
+	}
+	order.ID, err = res.LastInsertId()
+	return order, err
+}
+
+// getChairOrders email の購入記録を新しい順に返す
+func getChairOrders(c echo.Context) error {
+	email := c.QueryParam("email")
+	if email == "" {
+		c.Logger().Infof("getChairOrders : email is required")
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	res := ChairOrderListResponse{Orders: []ChairOrder{}}
+	err := db.Select(&res.Orders, "SELECT id, chair_id, email, price, quantity, created_at FROM chair_order WHERE email = ? ORDER BY id DESC", email)
+	if err != nil {
+		c.Logger().Errorf("getChairOrders DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, res)
+}
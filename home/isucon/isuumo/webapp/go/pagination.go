@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+const MaxPerPage = 100
+
+// Pagination page/perPage による LIMIT ? OFFSET ? 相当のページ指定
+// After が指定されている場合は page を使わずに (popularity, id) の続きから返す
+type Pagination struct {
+	Page    int
+	PerPage int
+	After   *Cursor
+}
+
+// Cursor popularity DESC, id ASC で最後に返した行
+type Cursor struct {
+	Popularity int64
+	ID         int64
+}
+
+func (c Cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d,%d", c.Popularity, c.ID)))
+}
+
+func parseCursor(s string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var cursor Cursor
+	if _, err := fmt.Sscanf(string(b), "%d,%d", &cursor.Popularity, &cursor.ID); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// Less c より前に並ぶ行なら true
+func (c Cursor) Less(popularity, id int64) bool {
+	if popularity == c.Popularity {
+		return id <= c.ID
+	}
+	return popularity > c.Popularity
+}
+
+func parsePagination(c echo.Context) (Pagination, error) {
+	perPage, err := strconv.Atoi(c.QueryParam("perPage"))
+	if err != nil {
+		return Pagination{}, fmt.Errorf("invalid format perPage parameter : %v", err)
+	}
+	if s := c.QueryParam("cursor"); s != "" {
+		cursor, err := parseCursor(s)
+		if err != nil {
+			return Pagination{}, fmt.Errorf("invalid format cursor parameter : %v", err)
+		}
+		p, err := newPagination(0, perPage)
+		p.After = cursor
+		return p, err
+	}
+	page, err := strconv.Atoi(c.QueryParam("page"))
+	if err != nil {
+		return Pagination{}, fmt.Errorf("invalid format page parameter : %v", err)
+	}
+	return newPagination(page, perPage)
+}
+
+// parseOptionalPagination page, perPage, cursor をそれぞれ無くてもよいものとして読む
+// 無い page は 0、無い perPage は defaultPerPage とする
+func parseOptionalPagination(c echo.Context, defaultPerPage int) (Pagination, error) {
+	perPage, page := defaultPerPage, 0
+	var err error
+	if s := c.QueryParam("perPage"); s != "" {
+		perPage, err = strconv.Atoi(s)
+		if err != nil {
+			return Pagination{}, fmt.Errorf("invalid format perPage parameter : %v", err)
+		}
+	}
+	if s := c.QueryParam("page"); s != "" {
+		page, err = strconv.Atoi(s)
+		if err != nil {
+			return Pagination{}, fmt.Errorf("invalid format page parameter : %v", err)
+		}
+	}
+	var cursor *Cursor
+	if s := c.QueryParam("cursor"); s != "" {
+		cursor, err = parseCursor(s)
+		if err != nil {
+			return Pagination{}, fmt.Errorf("invalid format cursor parameter : %v", err)
+		}
+		page = 0
+	}
+	p, err := newPagination(page, perPage)
+	p.After = cursor
+	return p, err
+}
+
+func newPagination(page, perPage int) (Pagination, error) {
+	if page < 0 {
+		return Pagination{}, fmt.Errorf("page must not be negative : %v", page)
+	}
+	if perPage <= 0 {
+		return Pagination{}, fmt.Errorf("perPage must be positive : %v", perPage)
+	}
+	if perPage > MaxPerPage {
+		perPage = MaxPerPage
+	}
+	return Pagination{Page: page, PerPage: perPage}, nil
+}
+
+func (p Pagination) Offset() int {
+	return p.Page * p.PerPage
+}
+
+func (p Pagination) Limit() int {
+	return p.PerPage
+}
+
+// KeysetSQL WHERE 句に AND で付け足す cursor の条件
+func (p Pagination) KeysetSQL(params []interface{}) (string, []interface{}) {
+	if p.After == nil {
+		return "", params
+	}
+	return " AND (popularity < ? OR (popularity = ? AND id > ?))", append(params, p.After.Popularity, p.After.Popularity, p.After.ID)
+}
+
+// SQL ORDER BY の後ろに付ける句とそのパラメータ
+func (p Pagination) SQL(params []interface{}) (string, []interface{}) {
+	return " LIMIT ? OFFSET ?", append(params, p.Limit(), p.Offset())
+}
+
+// NextCursor n 件返したページの次を指す cursor 、ページが埋まらなかった場合は空文字
+func (p Pagination) NextCursor(n int, last Cursor) string {
+	if n < p.Limit() {
+		return ""
+	}
+	return last.String()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewPagination(t *testing.T) {
+	tests := []struct {
+		page, perPage int
+		want          Pagination
+		wantErr       bool
+	}{
+		{page: 0, perPage: 25, want: Pagination{Page: 0, PerPage: 25}},
+		{page: 3, perPage: MaxPerPage + 1, want: Pagination{Page: 3, PerPage: MaxPerPage}},
+		{page: -1, perPage: 25, wantErr: true},
+		{page: 0, perPage: 0, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := newPagination(tt.page, tt.perPage)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("newPagination(%v, %v) error = %v, wantErr %v", tt.page, tt.perPage, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("newPagination(%v, %v) = %+v, want %+v", tt.page, tt.perPage, got, tt.want)
+		}
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	c := Cursor{Popularity: 12345, ID: 67}
+	got, err := parseCursor(c.String())
+	if err != nil || *got != c {
+		t.Errorf("parseCursor(%q) = %+v, %v", c.String(), got, err)
+	}
+	if _, err := parseCursor("!!"); err == nil {
+		t.Error("parseCursor accepted an invalid cursor")
+	}
+}
+
+// testPaginations offset のページ (最後のページより後ろを含む) と、途中の行を指す cursor
+func testPaginations(t *testing.T, cursors []Cursor) []Pagination {
+	var ps []Pagination
+	for _, perPage := range []int{1, 7, 25, MaxPerPage} {
+		for _, page := range []int{0, 1, 3, 1000} {
+			p, err := newPagination(page, perPage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ps = append(ps, p)
+		}
+		for i := range cursors {
+			p, _ := newPagination(0, perPage)
+			p.After = &cursors[i]
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+func TestEstateSearchMatchesSQL(t *testing.T) {
+	openTestDB(t)
+	estates := testEstates(600)
+	insertTestEstates(t, estates)
+	index := newEstateIndex(estates)
+
+	cursors := []Cursor{
+		{Popularity: estates[10].Popularity, ID: estates[10].ID},
+		{Popularity: estates[500].Popularity, ID: estates[500].ID},
+		{Popularity: -1, ID: 0},
+	}
+	filters := []EstateSearchFilter{
+		{Rent: estateSearchCondition.Rent.Ranges[1]},
+		{DoorWidth: estateSearchCondition.DoorWidth.Ranges[2], DoorHeight: estateSearchCondition.DoorHeight.Ranges[3]},
+		{Features: []string{estateSearchCondition.Feature.List[0]}},
+		{Rent: estateSearchCondition.Rent.Ranges[0], Features: []string{estateSearchCondition.Feature.List[1], estateSearchCondition.Feature.List[2]}},
+	}
+	for _, f := range filters {
+		for _, p := range testPaginations(t, cursors) {
+			count, got, err := index.Search(f, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			condition, params := f.sql()
+			wantCount, want, err := searchEstatesSQL(condition, params, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != wantCount || !reflect.DeepEqual(got, want) {
+				t.Errorf("filter %+v, pagination %+v : index returned %v %v, SQL returned %v %v", f, p, count, got, wantCount, want)
+			}
+		}
+	}
+}
+
+func TestChairSearchMatchesSQL(t *testing.T) {
+	openTestDB(t)
+	chairs := testChairs(600)
+	insertTestChairs(t, chairs)
+	cache := &ChairCache{}
+	cache.Load(chairs)
+
+	cursors := []Cursor{
+		{Popularity: chairs[10].Popularity, ID: chairs[10].ID},
+		{Popularity: chairs[500].Popularity, ID: chairs[500].ID},
+		{Popularity: -1, ID: 0},
+	}
+	filters := []ChairSearchFilter{
+		{Price: chairSearchCondition.Price.Ranges[2]},
+		{Height: chairSearchCondition.Height.Ranges[1], Width: chairSearchCondition.Width.Ranges[2]},
+		{Kind: chairSearchCondition.Kind.List[0]},
+		{Color: chairSearchCondition.Color.List[1], Features: []string{chairSearchCondition.Feature.List[0]}},
+	}
+	for _, f := range filters {
+		for _, p := range testPaginations(t, cursors) {
+			count, got, _ := cache.Search(f, p)
+			wantCount, want, err := searchChairsSQL(f, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != wantCount || !reflect.DeepEqual(got, want) {
+				t.Errorf("filter %+v, pagination %+v : cache returned %v %v, SQL returned %v %v", f, p, count, got, wantCount, want)
+			}
+		}
+	}
+}
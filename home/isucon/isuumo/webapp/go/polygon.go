@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	minPolygonPoints = 4
+	// maxPolygonPoints 図形全体の頂点数の上限、自己交差の判定は頂点数の2乗に比例する
+	maxPolygonPoints = 1000
+	// minPolygonArea 面積が (緯度経度の2乗で) これより小さいリングは、一直線に並んだ点とみなす
+	minPolygonArea = 1e-10
+)
+
+// PolygonError なぞって検索の図形が不正なときに 400 で返す内容
+type PolygonError struct {
+	Reason  string `json:"reason"`
+	Polygon int    `json:"polygon"`
+	Ring    int    `json:"ring"`
+	Index   int    `json:"index"`
+}
+
+func (e *PolygonError) Error() string {
+	return fmt.Sprintf("%s (polygon %d, ring %d, index %d)", e.Reason, e.Polygon, e.Ring, e.Index)
+}
+
+// Polygon 最初のリングが外周、残りが穴
+type Polygon []Coordinates
+
+// Shape なぞって検索の図形、いずれかのポリゴンに含まれる点を対象とする
+type Shape struct {
+	Polygons []Polygon
+}
+
+// ShapeRequest なぞって検索のリクエスト
+// type が無ければ従来の {"coordinates": [{"latitude", "longitude"}]} 、
+// Polygon, MultiPolygon なら GeoJSON の geometry として [経度, 緯度] の配列を読む
+type ShapeRequest struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+func geoJSONRing(positions [][]float64) (Coordinates, *PolygonError) {
+	cs := Coordinates{Coordinates: make([]Coordinate, 0, len(positions))}
+	for i, p := range positions {
+		if len(p) < 2 {
+			return cs, &PolygonError{Reason: "position must have longitude and latitude", Index: i}
+		}
+		cs.Coordinates = append(cs.Coordinates, Coordinate{Latitude: p[1], Longitude: p[0]})
+	}
+	return cs, nil
+}
+
+func geoJSONPolygon(rings [][][]float64) (Polygon, *PolygonError) {
+	polygon := make(Polygon, 0, len(rings))
+	for i, positions := range rings {
+		ring, err := geoJSONRing(positions)
+		if err != nil {
+			err.Ring = i
+			return nil, err
+		}
+		polygon = append(polygon, ring)
+	}
+	return polygon, nil
+}
+
+func malformedCoordinates(err error) *PolygonError {
+	return &PolygonError{Reason: fmt.Sprintf("malformed coordinates : %v", err)}
+}
+
+// Shape 座標の形が読めなければ PolygonError を返す
+func (r ShapeRequest) Shape() (Shape, *PolygonError) {
+	switch r.Type {
+	case "":
+		var cs []Coordinate
+		if err := json.Unmarshal(r.Coordinates, &cs); err != nil {
+			return Shape{}, malformedCoordinates(err)
+		}
+		return Shape{Polygons: []Polygon{{Coordinates{Coordinates: cs}}}}, nil
+	case "Polygon":
+		var rings [][][]float64
+		if err := json.Unmarshal(r.Coordinates, &rings); err != nil {
+			return Shape{}, malformedCoordinates(err)
+		}
+		polygon, err := geoJSONPolygon(rings)
+		if err != nil {
+			return Shape{}, err
+		}
+		return Shape{Polygons: []Polygon{polygon}}, nil
+	case "MultiPolygon":
+		var polygons [][][][]float64
+		if err := json.Unmarshal(r.Coordinates, &polygons); err != nil {
+			return Shape{}, malformedCoordinates(err)
+		}
+		shape := Shape{Polygons: make([]Polygon, 0, len(polygons))}
+		for i, rings := range polygons {
+			polygon, err := geoJSONPolygon(rings)
+			if err != nil {
+				err.Polygon = i
+				return Shape{}, err
+			}
+			shape.Polygons = append(shape.Polygons, polygon)
+		}
+		return shape, nil
+	}
+	return Shape{}, &PolygonError{Reason: fmt.Sprintf("unsupported geometry type : %v", r.Type)}
+}
+
+func (s Shape) validate() error {
+	if len(s.Polygons) == 0 {
+		return &PolygonError{Reason: "no polygon"}
+	}
+	points := 0
+	for i, polygon := range s.Polygons {
+		for j, ring := range polygon {
+			points += len(ring.Coordinates)
+			if points > maxPolygonPoints {
+				return &PolygonError{Reason: fmt.Sprintf("shape has more than %d points", maxPolygonPoints), Polygon: i, Ring: j}
+			}
+		}
+	}
+	for i, polygon := range s.Polygons {
+		if len(polygon) == 0 {
+			return &PolygonError{Reason: "polygon has no ring", Polygon: i}
+		}
+		for j, ring := range polygon {
+			if err := ring.validate(); err != nil {
+				err.Polygon = i
+				err.Ring = j
+				return err
+			}
+		}
+	}
+
+	// 穴が外周の外にはみ出したり、ポリゴン同士が重なったりしていると
+	// インデックスと ST_Contains で含まれる点が変わるので受け付けない
+	indexes := s.polygonIndexes()
+	for i, pi := range indexes {
+		if err := pi.validateHoles(); err != nil {
+			err.Polygon = i
+			return err
+		}
+		for j := 0; j < i; j++ {
+			if k, overlap := polygonsOverlap(indexes[j], pi); overlap {
+				return &PolygonError{Reason: "polygons overlap", Polygon: i, Index: k}
+			}
+		}
+	}
+	return nil
+}
+
+// ringsTouch b の辺のうち a の辺と交わるか接するものの位置
+func ringsTouch(a, b []Coordinate) (int, bool) {
+	for k := 0; k+1 < len(b); k++ {
+		for l := 0; l+1 < len(a); l++ {
+			if segmentsIntersect(a[l], a[l+1], b[k], b[k+1]) {
+				return k, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// validateHoles 穴が外周の内側にあり、穴同士が重ならないか
+func (pi polygonIndex) validateHoles() *PolygonError {
+	outer := pi.rings[0]
+	for j := 1; j < len(pi.rings); j++ {
+		hole := pi.rings[j]
+		if k, touch := ringsTouch(outer, hole); touch {
+			return &PolygonError{Reason: "hole touches the outer ring", Ring: j, Index: k}
+		}
+		if ringLocate(outer, hole[0]) <= 0 {
+			return &PolygonError{Reason: "hole is not inside the outer ring", Ring: j}
+		}
+		for l := 1; l < j; l++ {
+			other := pi.rings[l]
+			if k, touch := ringsTouch(other, hole); touch {
+				return &PolygonError{Reason: "holes overlap", Ring: j, Index: k}
+			}
+			if ringLocate(other, hole[0]) >= 0 || ringLocate(hole, other[0]) >= 0 {
+				return &PolygonError{Reason: "holes overlap", Ring: j}
+			}
+		}
+	}
+	return nil
+}
+
+// polygonsOverlap b の外周が a の辺と交わるか、どちらかがもう一方の内側にあるか
+// 辺が交わらなければ、頂点を1つ調べれば内側かどうかが分かる
+func polygonsOverlap(a, b polygonIndex) (int, bool) {
+	for _, ring := range a.rings {
+		if k, touch := ringsTouch(ring, b.rings[0]); touch {
+			return k, true
+		}
+	}
+	for _, ring := range b.rings[1:] {
+		if k, touch := ringsTouch(a.rings[0], ring); touch {
+			return k, true
+		}
+	}
+	return 0, a.contains(b.rings[0][0]) || b.contains(a.rings[0][0])
+}
+
+func (s Shape) wkt() string {
+	polygons := make([]string, 0, len(s.Polygons))
+	for _, polygon := range s.Polygons {
+		rings := make([]string, 0, len(polygon))
+		for _, ring := range polygon {
+			rings = append(rings, ring.wkt())
+		}
+		polygons = append(polygons, "("+strings.Join(rings, ",")+")")
+	}
+	if len(polygons) == 1 {
+		return "POLYGON" + polygons[0]
+	}
+	return "MULTIPOLYGON(" + strings.Join(polygons, ",") + ")"
+}
+
+// ring 連続する重複点を除き、始点と終点が一致するように閉じた頂点列
+func (cs Coordinates) ring() []Coordinate {
+	ring := make([]Coordinate, 0, len(cs.Coordinates)+1)
+	for _, c := range cs.Coordinates {
+		if len(ring) > 0 && ring[len(ring)-1] == c {
+			continue
+		}
+		ring = append(ring, c)
+	}
+	if len(ring) > 0 && ring[0] != ring[len(ring)-1] {
+		ring = append(ring, ring[0])
+	}
+	return ring
+}
+
+func (cs Coordinates) validate() *PolygonError {
+	for i, c := range cs.Coordinates {
+		if c.Latitude < -90 || 90 < c.Latitude {
+			return &PolygonError{Reason: "latitude out of range", Index: i}
+		}
+		if c.Longitude < -180 || 180 < c.Longitude {
+			return &PolygonError{Reason: "longitude out of range", Index: i}
+		}
+	}
+
+	ring := cs.ring()
+	if len(ring) < minPolygonPoints {
+		return &PolygonError{Reason: fmt.Sprintf("polygon needs at least %d points including the closing point", minPolygonPoints), Index: len(ring)}
+	}
+
+	if math.Abs(signedArea(ring)) < minPolygonArea {
+		return &PolygonError{Reason: "polygon has no area"}
+	}
+
+	// 隣り合わない辺同士が交わっていないか調べる
+	n := len(ring) - 1
+	for i := 0; i < n; i++ {
+		for j := i + 2; j < n; j++ {
+			if i == 0 && j == n-1 {
+				continue
+			}
+			if segmentsIntersect(ring[i], ring[i+1], ring[j], ring[j+1]) {
+				return &PolygonError{Reason: "polygon is self-intersecting", Index: j}
+			}
+		}
+	}
+	return nil
+}
+
+// signedArea 閉じたリングの面積、向きによって符号が変わる
+// 桁落ちしないように最初の頂点からの差で計算する
+func signedArea(ring []Coordinate) float64 {
+	area := 0.0
+	o := ring[0]
+	for i := 1; i+1 < len(ring); i++ {
+		x1, y1 := ring[i].Longitude-o.Longitude, ring[i].Latitude-o.Latitude
+		x2, y2 := ring[i+1].Longitude-o.Longitude, ring[i+1].Latitude-o.Latitude
+		area += x1*y2 - x2*y1
+	}
+	return area / 2
+}
+
+func orientation(a, b, c Coordinate) int {
+	v := (b.Longitude-a.Longitude)*(c.Latitude-a.Latitude) - (b.Latitude-a.Latitude)*(c.Longitude-a.Longitude)
+	switch {
+	case v > 0:
+		return 1
+	case v < 0:
+		return -1
+	}
+	return 0
+}
+
+// onSegment a, b, c が同一直線上にあるときに c が線分 ab 上にあるか
+func onSegment(a, b, c Coordinate) bool {
+	return c.Longitude >= minFloat(a.Longitude, b.Longitude) && c.Longitude <= maxFloat(a.Longitude, b.Longitude) &&
+		c.Latitude >= minFloat(a.Latitude, b.Latitude) && c.Latitude <= maxFloat(a.Latitude, b.Latitude)
+}
+
+func segmentsIntersect(p1, p2, q1, q2 Coordinate) bool {
+	o1 := orientation(p1, p2, q1)
+	o2 := orientation(p1, p2, q2)
+	o3 := orientation(q1, q2, p1)
+	o4 := orientation(q1, q2, p2)
+	if o1 != o2 && o3 != o4 {
+		return true
+	}
+	return (o1 == 0 && onSegment(p1, p2, q1)) ||
+		(o2 == 0 && onSegment(p1, p2, q2)) ||
+		(o3 == 0 && onSegment(q1, q2, p1)) ||
+		(o4 == 0 && onSegment(q1, q2, p2))
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// wkt estate_location.location と同じ (経度 緯度) の順で書いたリング
+func (cs Coordinates) wkt() string {
+	ring := cs.ring()
+	points := make([]string, 0, len(ring))
+	for _, c := range ring {
+		points = append(points, strconv.FormatFloat(c.Longitude, 'f', -1, 64)+" "+strconv.FormatFloat(c.Latitude, 'f', -1, 64))
+	}
+	return "(" + strings.Join(points, ",") + ")"
+}
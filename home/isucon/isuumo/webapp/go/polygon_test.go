@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestShapeRequestMalformed(t *testing.T) {
+	tests := []struct {
+		body string
+		want PolygonError
+	}{
+		{body: `{"coordinates": [{"latitude": "a"}]}`},
+		{body: `{"type": "Polygon", "coordinates": [[[139.7, 35.6], [139.8]]]}`, want: PolygonError{Index: 1}},
+		{body: `{"type": "MultiPolygon", "coordinates": [[[[139.7, 35.6]]], [[[139.7, 35.6]], [[139.8]]]]}`, want: PolygonError{Polygon: 1, Ring: 1}},
+		{body: `{"type": "Point", "coordinates": [139.7, 35.6]}`},
+	}
+	for _, tt := range tests {
+		var req ShapeRequest
+		if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+			t.Fatal(err)
+		}
+		_, err := req.Shape()
+		if err == nil {
+			t.Errorf("Shape() accepted %s", tt.body)
+			continue
+		}
+		if err.Reason == "" || err.Polygon != tt.want.Polygon || err.Ring != tt.want.Ring || err.Index != tt.want.Index {
+			t.Errorf("Shape() of %s = %+v, want position %+v", tt.body, err, tt.want)
+		}
+	}
+}
+
+func TestShapeValidateTopology(t *testing.T) {
+	outer := testRing([2]float64{35.5, 139.5}, [2]float64{35.8, 139.5}, [2]float64{35.8, 139.8}, [2]float64{35.5, 139.8})
+	hole := testRing([2]float64{35.6, 139.6}, [2]float64{35.7, 139.6}, [2]float64{35.7, 139.7}, [2]float64{35.6, 139.7})
+	outside := testRing([2]float64{35.9, 139.6}, [2]float64{36.0, 139.6}, [2]float64{36.0, 139.7}, [2]float64{35.9, 139.7})
+	crossing := testRing([2]float64{35.6, 139.6}, [2]float64{35.9, 139.6}, [2]float64{35.9, 139.7}, [2]float64{35.6, 139.7})
+	inner := testRing([2]float64{35.62, 139.62}, [2]float64{35.68, 139.62}, [2]float64{35.68, 139.68}, [2]float64{35.62, 139.68})
+
+	tests := []struct {
+		name   string
+		shape  Shape
+		reason string
+	}{
+		{name: "hole", shape: Shape{Polygons: []Polygon{{outer, hole}}}},
+		{name: "hole outside", shape: Shape{Polygons: []Polygon{{outer, outside}}}, reason: "hole is not inside the outer ring"},
+		{name: "hole crossing", shape: Shape{Polygons: []Polygon{{outer, crossing}}}, reason: "hole touches the outer ring"},
+		{name: "nested holes", shape: Shape{Polygons: []Polygon{{outer, hole, inner}}}, reason: "holes overlap"},
+		{name: "disjoint", shape: Shape{Polygons: []Polygon{{outer}, {outside}}}},
+		{name: "island in hole", shape: Shape{Polygons: []Polygon{{outer, hole}, {inner}}}},
+		{name: "crossing polygons", shape: Shape{Polygons: []Polygon{{outer}, {crossing}}}, reason: "polygons overlap"},
+		{name: "contained polygon", shape: Shape{Polygons: []Polygon{{outer}, {inner}}}, reason: "polygons overlap"},
+		{name: "containing polygon", shape: Shape{Polygons: []Polygon{{inner}, {outer}}}, reason: "polygons overlap"},
+	}
+	for _, tt := range tests {
+		err := tt.shape.validate()
+		if tt.reason == "" {
+			if err != nil {
+				t.Errorf("%v : validate() = %v", tt.name, err)
+			}
+			continue
+		}
+		perr, ok := err.(*PolygonError)
+		if !ok || perr.Reason != tt.reason {
+			t.Errorf("%v : validate() = %v, want %q", tt.name, err, tt.reason)
+		}
+	}
+}
+
+func TestCoordinatesValidateDegenerate(t *testing.T) {
+	tests := []struct {
+		name   string
+		ring   Coordinates
+		reason string
+	}{
+		{name: "collinear", ring: testRing([2]float64{35, 139}, [2]float64{35.1, 139.1}, [2]float64{35.2, 139.2}), reason: "polygon has no area"},
+		{name: "collinear with closing point", ring: testRing([2]float64{35, 139}, [2]float64{35.1, 139.1}, [2]float64{35.2, 139.2}, [2]float64{35, 139}), reason: "polygon has no area"},
+		{name: "back and forth", ring: testRing([2]float64{35.6, 139.6}, [2]float64{35.7, 139.7}, [2]float64{35.6, 139.6}, [2]float64{35.7, 139.7}), reason: "polygon has no area"},
+		{name: "small triangle", ring: testRing([2]float64{35.6, 139.6}, [2]float64{35.6001, 139.6}, [2]float64{35.6, 139.6001})},
+	}
+	for _, tt := range tests {
+		err := tt.ring.validate()
+		if tt.reason == "" {
+			if err != nil {
+				t.Errorf("%v : validate() = %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Reason != tt.reason {
+			t.Errorf("%v : validate() = %v, want %q", tt.name, err, tt.reason)
+		}
+	}
+}
+
+func TestShapeValidateTooManyPoints(t *testing.T) {
+	ring := Coordinates{}
+	for i := 0; i <= maxPolygonPoints; i++ {
+		a := 2 * math.Pi * float64(i) / float64(maxPolygonPoints+1)
+		ring.Coordinates = append(ring.Coordinates, Coordinate{Latitude: 35.6 + 0.1*math.Sin(a), Longitude: 139.6 + 0.1*math.Cos(a)})
+	}
+	err := Shape{Polygons: []Polygon{{ring}}}.validate()
+	perr, ok := err.(*PolygonError)
+	if !ok || perr.Reason != fmt.Sprintf("shape has more than %d points", maxPolygonPoints) {
+		t.Errorf("validate() = %v", err)
+	}
+
+	ring.Coordinates = ring.Coordinates[:maxPolygonPoints]
+	if err := (Shape{Polygons: []Polygon{{ring}}}).validate(); err != nil {
+		t.Errorf("validate() of %d points = %v", maxPolygonPoints, err)
+	}
+}
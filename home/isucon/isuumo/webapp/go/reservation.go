@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	ReservationStatusHeld      = "held"
+	ReservationStatusConfirmed = "confirmed"
+	ReservationStatusReleased  = "released"
+	// ReservationStatusCancelled 椅子が削除されたり在庫が上書きされたりして取り消された
+	ReservationStatusCancelled = "cancelled"
+
+	maxReservationTTL           = time.Hour
+	reservationSweepInterval    = 10 * time.Second
+	maxSweptReservationsPerTurn = 100
+)
+
+// ChairReservation 支払いが済むまで椅子を取り置く、取り置いた分は予約の時点で stock から減らす
+type ChairReservation struct {
+	ID        int64     `db:"id" json:"id"`
+	ChairID   int64     `db:"chair_id" json:"chairId"`
+	Email     string    `db:"email" json:"email"`
+	Quantity  int64     `db:"quantity" json:"quantity"`
+	Status    string    `db:"status" json:"status"`
+	ExpiresAt time.Time `db:"expires_at" json:"expiresAt"`
+	// Token 予約を確定するときに必要になる、予約したときのレスポンスでだけ返す
+	Token string `db:"token" json:"token,omitempty"`
+}
+
+type ChairReservationRequest struct {
+	Email      string `json:"email"`
+	Quantity   int64  `json:"quantity"`
+	TTLSeconds int64  `json:"ttlSeconds"`
+}
+
+type ChairReservationConfirmRequest struct {
+	Token string `json:"token"`
+}
+
+// defaultReservationTTL RESERVATION_TTL_SECONDS で変えられる
+func defaultReservationTTL() time.Duration {
+	seconds, err := strconv.Atoi(getEnv("RESERVATION_TTL_SECONDS", "600"))
+	if err != nil || seconds <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func (r *ChairReservationRequest) ttl() (time.Duration, error) {
+	if r.TTLSeconds == 0 {
+		return defaultReservationTTL(), nil
+	}
+	// 掛け算があふれないように秒のまま比べる
+	if r.TTLSeconds < 0 || r.TTLSeconds > int64(maxReservationTTL/time.Second) {
+		return 0, fmt.Errorf("ttlSeconds must be between 1 and %v : %v", int64(maxReservationTTL/time.Second), r.TTLSeconds)
+	}
+	return time.Duration(r.TTLSeconds) * time.Second, nil
+}
+
+func newReservationToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// reserveChair 在庫から quantity 個を取り置く
+func reserveChair(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.Logger().Infof("reserveChair : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	var req ChairReservationRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Infof("reserveChair : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if req.Email == "" {
+		c.Logger().Info("reserveChair : email not found in request body")
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+	if req.Quantity < 0 {
+		c.Logger().Infof("reserveChair : quantity must be positive : %v", req.Quantity)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	ttl, err := req.ttl()
+	if err != nil {
+		c.Logger().Infof("reserveChair : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	token, err := newReservationToken()
+	if err != nil {
+		c.Logger().Errorf("failed to create reservation token : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("failed to create transaction : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	held, err := decrementChairStock(tx, id, req.Quantity)
+	if err != nil {
+		c.Logger().Errorf("chair stock update failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !held {
+		c.Logger().Infof("reserveChair chair id \"%v\" not found or sold out", id)
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	reservation := ChairReservation{
+		ChairID:   id,
+		Email:     req.Email,
+		Quantity:  req.Quantity,
+		Status:    ReservationStatusHeld,
+		ExpiresAt: time.Now().UTC().Add(ttl).Truncate(time.Microsecond),
+		Token:     token,
+	}
+	res, err := tx.Exec("INSERT INTO chair_reservation(chair_id, email, quantity, status, expires_at, token) VALUES (?, ?, ?, ?, ?, ?)",
+		reservation.ChairID, reservation.Email, reservation.Quantity, reservation.Status, reservation.ExpiresAt, reservation.Token)
+	if err != nil {
+		c.Logger().Errorf("chair reservation insert failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	reservation.ID, err = res.LastInsertId()
+	if err != nil {
+		c.Logger().Errorf("chair reservation insert failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	body, err := saveIdempotentJSON(c, tx, http.StatusCreated, reservation)
+	if err != nil {
+		c.Logger().Errorf("reserveChair idempotency key update failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := commitChairStock(tx, func() { chairCache.DecrementStock(id, req.Quantity) }); err != nil {
+		c.Logger().Errorf("transaction commit error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSONBlob(http.StatusCreated, body)
+}
+
+// confirmChairReservation 期限内の予約を buyChair と同じ sellChair で購入にする
+// 予約したときに返した token が必要で、id だけでは他人の予約を確定できない
+func confirmChairReservation(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.Logger().Infof("confirmChairReservation : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	var req ChairReservationConfirmRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Infof("confirmChairReservation : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if req.Token == "" {
+		c.Logger().Info("confirmChairReservation : token not found in request body")
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("failed to create transaction : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var reservation ChairReservation
+	err = tx.Get(&reservation, "SELECT id, chair_id, email, quantity, status, expires_at, token FROM chair_reservation WHERE id = ? FOR UPDATE", id)
+	if err == sql.ErrNoRows {
+		c.Logger().Infof("confirmChairReservation reservation id \"%v\" not found", id)
+		return c.NoContent(http.StatusNotFound)
+	}
+	if err != nil {
+		c.Logger().Errorf("confirmChairReservation DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// 予約があるかどうかを token なしで確かめられないように、token が違うときも 404 にする
+	if subtle.ConstantTimeCompare([]byte(reservation.Token), []byte(req.Token)) != 1 {
+		c.Logger().Infof("confirmChairReservation reservation id \"%v\" token mismatch", id)
+		return c.NoContent(http.StatusNotFound)
+	}
+	// 取り消された予約は、椅子が削除されたか在庫が上書きされている
+	if reservation.Status != ReservationStatusHeld || !time.Now().Before(reservation.ExpiresAt) {
+		c.Logger().Infof("confirmChairReservation reservation id \"%v\" is %v", id, reservation.Status)
+		return c.NoContent(http.StatusGone)
+	}
+
+	_, err = tx.Exec("UPDATE chair_reservation SET status = ? WHERE id = ?", ReservationStatusConfirmed, id)
+	if err != nil {
+		c.Logger().Errorf("chair reservation update failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	order, err := sellChair(tx, reservation.ChairID, reservation.Email, reservation.Quantity, true)
+	if err == errChairSoldOut {
+		c.Logger().Infof("confirmChairReservation chair id \"%v\" not found", reservation.ChairID)
+		return c.NoContent(http.StatusNotFound)
+	}
+	if err != nil {
+		c.Logger().Errorf("confirmChairReservation DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	body, err := saveIdempotentJSON(c, tx, http.StatusOK, order)
+	if err != nil {
+		c.Logger().Errorf("confirmChairReservation idempotency key update failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Errorf("transaction commit error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSONBlob(http.StatusOK, body)
+}
+
+// execer *sql.Tx と *sqlx.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// cancelChairReservations 椅子を削除したり在庫を上書きしたりするときに、その椅子の保留中の予約を取り消す
+// 取り置いた分は在庫に戻さない、上書きした在庫に期限切れの後で予約の分が足されないようにするため
+func cancelChairReservations(tx execer, chairIDs []int64) error {
+	if len(chairIDs) == 0 {
+		return nil
+	}
+	params := make([]interface{}, 0, len(chairIDs)+2)
+	params = append(params, ReservationStatusCancelled, ReservationStatusHeld)
+	for _, id := range chairIDs {
+		params = append(params, id)
+	}
+	query := "UPDATE chair_reservation SET status = ? WHERE status = ? AND chair_id IN (?" + strings.Repeat(", ?", len(chairIDs)-1) + ")"
+	_, err := tx.Exec(query, params...)
+	return err
+}
+
+// releaseExpiredReservations 期限切れの予約を解放して在庫に戻し、解放した数を返す
+func releaseExpiredReservations(now time.Time) (int, error) {
+	expired := []ChairReservation{}
+	err := db.Select(&expired, "SELECT id, chair_id, email, quantity, status, expires_at FROM chair_reservation WHERE status = ? AND expires_at <= ? ORDER BY expires_at LIMIT ?",
+		ReservationStatusHeld, now, maxSweptReservationsPerTurn)
+	if err != nil {
+		return 0, err
+	}
+
+	released := 0
+	for _, reservation := range expired {
+		ok, err := releaseReservation(&reservation)
+		if err != nil {
+			return released, err
+		}
+		if ok {
+			released++
+		}
+	}
+	return released, nil
+}
+
+// releaseReservation 確定と競合したときは何もせず false を返す
+func releaseReservation(reservation *ChairReservation) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE chair_reservation SET status = ? WHERE id = ? AND status = ?", ReservationStatusReleased, reservation.ID, ReservationStatusHeld)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	_, err = tx.Exec("UPDATE chair SET stock = stock + ?, stock_flag = stock > 0 WHERE id = ?", reservation.Quantity, reservation.ChairID)
+	if err != nil {
+		return false, err
+	}
+	if err := commitChairStock(tx, func() { chairCache.IncrementStock(reservation.ChairID, reservation.Quantity) }); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sweepChairReservations reservationSweepInterval ごとに期限切れの予約を解放する
+func sweepChairReservations(logger echo.Logger) {
+	ticker := time.NewTicker(reservationSweepInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		n, err := releaseExpiredReservations(now.UTC())
+		if err != nil {
+			logger.Errorf("sweepChairReservations : %v", err)
+			continue
+		}
+		if n > 0 {
+			logger.Infof("sweepChairReservations released %v reservations", n)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+func TestChairReservationRequestTTL(t *testing.T) {
+	tests := []struct {
+		seconds int64
+		want    time.Duration
+		ok      bool
+	}{
+		{seconds: 1, want: time.Second, ok: true},
+		{seconds: int64(maxReservationTTL / time.Second), want: maxReservationTTL, ok: true},
+		{seconds: int64(maxReservationTTL/time.Second) + 1},
+		{seconds: -1},
+		// time.Second を掛けるとあふれて負や小さな値になる
+		{seconds: math.MaxInt64},
+		{seconds: math.MaxInt64/int64(time.Second) + 1},
+	}
+	for _, tt := range tests {
+		r := ChairReservationRequest{TTLSeconds: tt.seconds}
+		got, err := r.ttl()
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ttl(%v) = %v, %v, want %v", tt.seconds, got, err, tt.want)
+		}
+	}
+}
+
+func serveReservation(e *echo.Echo, handler echo.HandlerFunc, id int64, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/chair/reservation", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(fmt.Sprint(id))
+	if err := handler(c); err != nil {
+		e.HTTPErrorHandler(err, c)
+	}
+	return rec
+}
+
+func TestConfirmChairReservationToken(t *testing.T) {
+	openTestDB(t)
+	chair := testChairs(1)[0]
+	chair.Stock = 1
+	insertTestChairs(t, []Chair{chair})
+
+	e := echo.New()
+	rec := serveReservation(e, reserveChair, chair.ID, `{"email":"buyer@example.com"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("reserveChair status = %v", rec.Code)
+	}
+	var reservation ChairReservation
+	if err := json.Unmarshal(rec.Body.Bytes(), &reservation); err != nil {
+		t.Fatal(err)
+	}
+	if len(reservation.Token) != 64 {
+		t.Fatalf("token = %q", reservation.Token)
+	}
+
+	if rec := serveReservation(e, confirmChairReservation, reservation.ID, `{}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("confirm without token: status = %v, want %v", rec.Code, http.StatusBadRequest)
+	}
+	if rec := serveReservation(e, confirmChairReservation, reservation.ID, `{"token":"`+strings.Repeat("0", 64)+`"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("confirm with a wrong token: status = %v, want %v", rec.Code, http.StatusNotFound)
+	}
+	if rec := serveReservation(e, confirmChairReservation, reservation.ID, `{"token":"`+reservation.Token+`"}`); rec.Code != http.StatusOK {
+		t.Errorf("confirm with the token: status = %v, want %v", rec.Code, http.StatusOK)
+	}
+}
+
+func reserveTestChair(t *testing.T, e *echo.Echo, id int64, quantity int64) ChairReservation {
+	t.Helper()
+	rec := serveReservation(e, reserveChair, id, fmt.Sprintf(`{"email":"buyer@example.com","quantity":%d}`, quantity))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("reserveChair status = %v", rec.Code)
+	}
+	var reservation ChairReservation
+	if err := json.Unmarshal(rec.Body.Bytes(), &reservation); err != nil {
+		t.Fatal(err)
+	}
+	return reservation
+}
+
+// TestChairReservationsCancelled 上書きや削除された椅子の予約は、確定も在庫への返却もされない
+func TestChairReservationsCancelled(t *testing.T) {
+	openTestDB(t)
+	chairs := testChairs(2)
+	chairs[0].Stock = 3
+	chairs[1].Stock = 3
+	insertTestChairs(t, chairs)
+	e := echo.New()
+
+	upserted := reserveTestChair(t, e, chairs[0].ID, 2)
+	deleted := reserveTestChair(t, e, chairs[1].ID, 2)
+
+	chairs[0].Stock = 5
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	batch := &chairBatch{tx: tx, upsert: true, rows: chairs[:1]}
+	if err := batch.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := serveReservation(e, deleteChair, chairs[1].ID, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("deleteChair status = %v", rec.Code)
+	}
+
+	for _, r := range []ChairReservation{upserted, deleted} {
+		rec := serveReservation(e, confirmChairReservation, r.ID, `{"token":"`+r.Token+`"}`)
+		if rec.Code != http.StatusGone {
+			t.Errorf("confirm reservation of chair %v : status = %v, want %v", r.ChairID, rec.Code, http.StatusGone)
+		}
+	}
+
+	released, err := releaseExpiredReservations(time.Now().UTC().Add(2 * maxReservationTTL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released != 0 {
+		t.Errorf("released %v cancelled reservations", released)
+	}
+	var stock int64
+	if err := db.Get(&stock, "SELECT stock FROM chair WHERE id = ?", chairs[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if stock != 5 {
+		t.Errorf("stock after upsert = %v, want the imported 5", stock)
+	}
+	var orders int
+	if err := db.Get(&orders, "SELECT COUNT(*) FROM chair_order"); err != nil {
+		t.Fatal(err)
+	}
+	if orders != 0 {
+		t.Errorf("%v chair_order rows for cancelled reservations", orders)
+	}
+}
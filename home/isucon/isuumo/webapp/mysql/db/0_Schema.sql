@@ -3,6 +3,9 @@ CREATE DATABASE isuumo;
 
 DROP TABLE IF EXISTS isuumo.estate;
 DROP TABLE IF EXISTS isuumo.chair;
+DROP TABLE IF EXISTS isuumo.chair_order;
+DROP TABLE IF EXISTS isuumo.idempotency_key;
+DROP TABLE IF EXISTS isuumo.chair_reservation;
 
 CREATE TABLE isuumo.estate
 (
@@ -55,3 +58,37 @@ CREATE TABLE isuumo.chair
     INDEX IX_chairs_stock_flag_height(stock_flag, height),
     INDEX IX_chairs_stock_flag_color_popularity(stock_flag, color, popularity)
 );
+
+CREATE TABLE isuumo.chair_order
+(
+    id          INTEGER      NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    chair_id    INTEGER      NOT NULL,
+    email       VARCHAR(256) NOT NULL,
+    price       INTEGER      NOT NULL,
+    quantity    INTEGER      NOT NULL DEFAULT 1,
+    created_at  DATETIME(6)  NOT NULL,
+    INDEX IX_chair_order_email_id(email, id)
+);
+
+CREATE TABLE isuumo.idempotency_key
+(
+    idempotency_key VARCHAR(255) NOT NULL PRIMARY KEY,
+    request_hash    CHAR(64)     NOT NULL,
+    status          INTEGER      NOT NULL,
+    content_type    VARCHAR(128) NOT NULL,
+    body            MEDIUMBLOB   NOT NULL,
+    created_at      DATETIME(6)  NOT NULL,
+    INDEX IX_idempotency_key_created_at(created_at)
+);
+
+CREATE TABLE isuumo.chair_reservation
+(
+    id          INTEGER      NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    chair_id    INTEGER      NOT NULL,
+    email       VARCHAR(256) NOT NULL,
+    quantity    INTEGER      NOT NULL,
+    status      VARCHAR(16)  NOT NULL,
+    expires_at  DATETIME(6)  NOT NULL,
+    token       CHAR(64)     NOT NULL,
+    INDEX IX_chair_reservation_status_expires_at(status, expires_at)
+);
@@ -12,3 +12,6 @@ export LANG="C.UTF-8"
 cd $CURRENT_DIR
 
 cat 0_Schema.sql 1_DummyEstateData.sql 2_DummyChairData.sql 4_DummyEstateLocationData.sql 6_MigrateStockFlag.sql | mysql --defaults-file=/dev/null -h $MYSQL_HOST -P $MYSQL_PORT -u $MYSQL_USER $MYSQL_DBNAME
+
+# rent_category は estate_condition.json から計算する
+cd ../../go && make isuumo && ./isuumo repair-rent-category